@@ -0,0 +1,127 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"log/slog"
+	"net"
+	"net/http"
+	"os"
+	"strconv"
+	"sync"
+	"text/template"
+	"time"
+)
+
+// Predefined formats of the access log.
+const (
+	AccessLogCommon   = "common"
+	AccessLogCombined = "combined"
+)
+
+var accessLogFormats = map[string]string{
+	AccessLogCommon:   `{{.Host}} - {{.User}} [{{.Time}}] "{{.Method}} {{.URI}} {{.Proto}}" {{.Status}} {{.Bytes}}`,
+	AccessLogCombined: `{{.Host}} - {{.User}} [{{.Time}}] "{{.Method}} {{.URI}} {{.Proto}}" {{.Status}} {{.Bytes}} "{{.Referer}}" "{{.UserAgent}}"`,
+}
+
+// AccessLog writes a line per request handled by the proxy. A nil AccessLog
+// logs nothing.
+type AccessLog struct {
+	w    io.Writer
+	tmpl *template.Template
+
+	mu sync.Mutex
+}
+
+// accessLogEntry is the data of the template of an access log line. Strings
+// are escaped to be quoted, and missing values are "-".
+type accessLogEntry struct {
+	Host      string
+	User      string
+	Time      string // in the format of the common log
+	Method    string
+	URI       string
+	Proto     string
+	Status    int
+	Bytes     string
+	Referer   string
+	UserAgent string
+	Duration  time.Duration
+}
+
+// OpenAccessLog opens the access log appending to the file at path, or
+// writing to stdout if path is "-". format is common, combined or a
+// text/template of accessLogEntry.
+func OpenAccessLog(path string, format string) (*AccessLog, error) {
+	if f, ok := accessLogFormats[format]; ok {
+		format = f
+	}
+	tmpl, err := template.New("access log").Parse(format)
+	if err != nil {
+		return nil, fmt.Errorf("invalid format: %w", err)
+	}
+	if path == "-" {
+		return &AccessLog{w: os.Stdout, tmpl: tmpl}, nil
+	}
+	f, err := os.OpenFile(path, os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0o644)
+	if err != nil {
+		return nil, err
+	}
+	return &AccessLog{w: f, tmpl: tmpl}, nil
+}
+
+// Log writes the line of a request started at start and answered with code
+// and n bytes.
+func (l *AccessLog) Log(req *http.Request, code int, n int64, start time.Time) {
+	if l == nil {
+		return
+	}
+	host, _, err := net.SplitHostPort(req.RemoteAddr)
+	if err != nil {
+		host = req.RemoteAddr
+	}
+	user, _, _ := req.BasicAuth()
+	entry := accessLogEntry{
+		Host:      orDash(host),
+		User:      orDash(escapeQuoted(user)),
+		Time:      start.Format("02/Jan/2006:15:04:05 -0700"),
+		Method:    escapeQuoted(req.Method),
+		URI:       escapeQuoted(req.RequestURI),
+		Proto:     req.Proto,
+		Status:    code,
+		Bytes:     "-",
+		Referer:   orDash(escapeQuoted(req.Referer())),
+		UserAgent: orDash(escapeQuoted(req.UserAgent())),
+		Duration:  time.Since(start),
+	}
+	if n > 0 {
+		entry.Bytes = strconv.FormatInt(n, 10)
+	}
+
+	var buf bytes.Buffer
+	if err := l.tmpl.Execute(&buf, entry); err != nil {
+		slog.Warn("failed to format access log", "err", err)
+		return
+	}
+	buf.WriteByte('\n')
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if _, err := l.w.Write(buf.Bytes()); err != nil {
+		slog.Warn("failed to write access log", "err", err)
+	}
+}
+
+// escapeQuoted escapes quotes, backslashes and control characters in s, so
+// that it can't break quoted fields of log lines.
+func escapeQuoted(s string) string {
+	q := strconv.Quote(s)
+	return q[1 : len(q)-1]
+}
+
+func orDash(s string) string {
+	if s == "" {
+		return "-"
+	}
+	return s
+}
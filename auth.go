@@ -0,0 +1,83 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"os"
+	"strings"
+)
+
+// addHeaders sets the configured headers of the target on the request.
+func (t *TargetConfig) addHeaders(req *http.Request) {
+	for name, value := range t.Headers {
+		if strings.EqualFold(name, "Host") {
+			req.Host = value
+			continue
+		}
+		req.Header.Set(name, value)
+	}
+}
+
+// authorize adds the credentials of the target to the request. OAuth2 tokens
+// and AWS roles are fetched with the client, which must not be the one
+// scraping the target through its unix socket or proxy, see authClient.
+// Requests must not be changed after being signed with SigV4.
+func (t *TargetConfig) authorize(req *http.Request, client *http.Client) error {
+	if t.BasicAuth != nil {
+		password, err := readSecret(t.BasicAuth.Password, t.BasicAuth.PasswordFile)
+		if err != nil {
+			return err
+		}
+		req.SetBasicAuth(t.BasicAuth.Username, password)
+	}
+	if t.BearerToken != "" || t.BearerTokenFile != "" {
+		token, err := readSecret(t.BearerToken, t.BearerTokenFile)
+		if err != nil {
+			return err
+		}
+		req.Header.Set("Authorization", "Bearer "+token)
+	}
+	if t.OAuth2 != nil {
+		token, err := t.OAuth2.Token(req.Context(), client)
+		if err != nil {
+			return err
+		}
+		req.Header.Set("Authorization", "Bearer "+token)
+	}
+	if t.SigV4 != nil {
+		if err := t.SigV4.Sign(req, client); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// authClient returns the client to fetch OAuth2 tokens and AWS roles for the
+// target with, which is like client scraping it, except for the transport:
+// token and STS endpoints aren't reached through the unix socket or proxy
+// of the target.
+func (p *Proxy) authClient(t *TargetConfig, client *http.Client) *http.Client {
+	if t.transport == nil || t.authTransport == t.transport {
+		return client
+	}
+	c := *client
+	c.Transport = p.Client.Transport
+	if t.authTransport != nil {
+		c.Transport = t.authTransport
+	}
+	c.Transport = p.tracedTransport(c.Transport)
+	return &c
+}
+
+// readSecret returns secret, or the content of file if set. Files are read on
+// every use, so that rotated secrets are picked up.
+func readSecret(secret, file string) (string, error) {
+	if file == "" {
+		return secret, nil
+	}
+	content, err := os.ReadFile(file)
+	if err != nil {
+		return "", fmt.Errorf("error reading secret: %w", err)
+	}
+	return strings.TrimSpace(string(content)), nil
+}
@@ -0,0 +1,27 @@
+package main
+
+import (
+	"github.com/prometheus/common/version"
+)
+
+// programName is the name printed by -version.
+const programName = "prometheus-expvar-proxy"
+
+// buildInfoFamily returns the expvar_exporter_build_info metric, which is
+// appended to every exposition, so that the versions of proxies can be
+// tracked. The version is set at build time with ldflags on
+// github.com/prometheus/common/version.
+func buildInfoFamily() metricFamily {
+	labels := []Label{
+		{Name: "branch", Value: version.Branch},
+		{Name: "goversion", Value: version.GoVersion},
+		{Name: "revision", Value: version.GetRevision()},
+		{Name: "version", Value: version.Version},
+	}
+	return metricFamily{
+		Name:    "expvar_exporter_build_info",
+		Help:    "A metric with a constant '1' value labeled by version, revision, branch and goversion of the proxy.",
+		Type:    "gauge",
+		Samples: []sample{{Name: "expvar_exporter_build_info", Labels: labels, Value: 1}},
+	}
+}
@@ -0,0 +1,61 @@
+package main
+
+import (
+	"fmt"
+	"net"
+	"net/netip"
+	"strings"
+)
+
+// ClientAllowlist lists the networks of clients allowed to use the proxy. An
+// empty list allows all clients.
+type ClientAllowlist []netip.Prefix
+
+// ParseClientAllowlist parses a comma-separated list of CIDRs or single IP
+// addresses, e.g. "10.0.0.0/8,192.168.1.10".
+func ParseClientAllowlist(list string) (ClientAllowlist, error) {
+	var allowlist ClientAllowlist
+	for _, entry := range strings.Split(list, ",") {
+		entry = strings.TrimSpace(entry)
+		if entry == "" {
+			continue
+		}
+		if !strings.Contains(entry, "/") {
+			addr, err := netip.ParseAddr(entry)
+			if err != nil {
+				return nil, fmt.Errorf("invalid client address %q: %w", entry, err)
+			}
+			allowlist = append(allowlist, netip.PrefixFrom(addr.Unmap(), addr.Unmap().BitLen()))
+			continue
+		}
+		prefix, err := netip.ParsePrefix(entry)
+		if err != nil {
+			return nil, fmt.Errorf("invalid client network %q: %w", entry, err)
+		}
+		allowlist = append(allowlist, prefix.Masked())
+	}
+	return allowlist, nil
+}
+
+// Allowed returns whether the client at remoteAddr, as in http.Request, is
+// allowed.
+func (al ClientAllowlist) Allowed(remoteAddr string) bool {
+	if len(al) == 0 {
+		return true
+	}
+	host, _, err := net.SplitHostPort(remoteAddr)
+	if err != nil {
+		host = remoteAddr
+	}
+	addr, err := netip.ParseAddr(host)
+	if err != nil {
+		return false
+	}
+	addr = addr.Unmap()
+	for _, prefix := range al {
+		if prefix.Contains(addr) {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,127 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"log/slog"
+	"net/http"
+	"net/url"
+
+	"github.com/relex/prometheus-expvar-proxy/expvarcollector"
+	"go.opentelemetry.io/otel/attribute"
+)
+
+// sample and Label are the flattened expvars of targets, which the proxy
+// passes around a lot.
+type (
+	sample = expvarcollector.Sample
+	Label  = expvarcollector.Label
+)
+
+// collect scrapes and flattens the expvars of the target, those at its extra
+// paths labeled by path, and those at its merge path, unless passed through
+// metrics of the target have the same names. The requests to the target are
+// canceled with ctx.
+func (p *Proxy) collect(ctx context.Context, client *http.Client, tc *TargetConfig) (_ []sample, err error) {
+	var read int64
+	defer func() {
+		p.Telemetry.Scrape(read, err)
+		expvarScrapes.Add(1)
+		if err != nil {
+			expvarScrapeErrors.Add(1)
+		}
+	}()
+
+	opts := p.Options
+	opts.Rules = tc.rules(p.Config())
+	if tc.module != nil {
+		opts.Format = tc.module.Format
+		if p.Names != nil {
+			opts.Names = tc.module.nameCache(p.Names.Size)
+		}
+	}
+	// Configured targets are scraped repeatedly, so the previous scrape tells
+	// how many samples to expect.
+	samples, n, err := p.decode(ctx, client, tc, tc.parsedURL, &opts, int(tc.lastSamples.Load()))
+	read += n
+	if err != nil {
+		return nil, err
+	}
+	if len(tc.pathURLs) > 0 {
+		samples = addTargetLabels(samples, []Label{{Name: "path", Value: tc.parsedURL.Path}})
+		for _, u := range tc.pathURLs {
+			more, n, err := p.decode(ctx, client, tc, u, &opts, 0)
+			read += n
+			if err != nil {
+				return nil, err
+			}
+			samples = append(samples, addTargetLabels(more, []Label{{Name: "path", Value: u.Path}})...)
+		}
+	}
+	if tc.mergeURL != nil {
+		// The merge path serves expvars even if the target doesn't.
+		opts.Format = expvarcollector.FormatExpvar
+		merged, n, err := p.decode(ctx, client, tc, tc.mergeURL, &opts, 0)
+		read += n
+		if err != nil {
+			return nil, err
+		}
+		merged = dropTakenFamilies(tc, samples, merged)
+		if len(tc.pathURLs) > 0 {
+			merged = addTargetLabels(merged, []Label{{Name: "path", Value: tc.mergeURL.Path}})
+		}
+		samples = append(samples, merged...)
+	}
+	tc.lastSamples.Store(int64(len(samples)))
+	return samples, nil
+}
+
+// dropTakenFamilies drops the merged expvars of tc whose names are taken by
+// the families passed through from the target, including the series of its
+// histograms and summaries, as a family can only be exposed once.
+func dropTakenFamilies(tc *TargetConfig, samples, merged []sample) []sample {
+	taken := make(map[string]bool, len(samples))
+	for _, s := range samples {
+		taken[s.Name] = true
+		if s.Histogram != nil || s.Summary != nil {
+			taken[s.Name+"_count"], taken[s.Name+"_sum"], taken[s.Name+"_bucket"] = true, true, true
+		}
+	}
+	kept := merged[:0]
+	dropped := make(map[string]bool)
+	for _, s := range merged {
+		if !taken[s.Name] {
+			kept = append(kept, s)
+		} else if !dropped[s.Name] {
+			dropped[s.Name] = true
+			slog.Warn("dropping merged expvar of the same name as a passed through metric", "target", tc.Name, "metric", s.Name)
+		}
+	}
+	return kept
+}
+
+// decode requests target of tc and flattens the response with opts. It
+// returns the samples and the number of decompressed bytes read.
+func (p *Proxy) decode(ctx context.Context, client *http.Client, tc *TargetConfig, target *url.URL, opts *expvarcollector.Options, sizeHint int) (_ []sample, read int64, err error) {
+	resp, err := p.get(ctx, client, tc, target)
+	if err != nil {
+		return nil, 0, err
+	}
+	defer resp.Body.Close()
+
+	_, span := p.tracer().Start(ctx, "parse")
+	defer func() {
+		span.SetAttributes(attribute.Int64("http.response.body.size", read))
+		endSpan(span, err)
+	}()
+
+	samples, read, err := expvarcollector.Decode(resp, target, opts, sizeHint)
+	if err != nil {
+		if errors.Is(err, expvarcollector.ErrInvalidExpvars) {
+			expvarParseErrors.Add(1)
+		}
+		return nil, read, err
+	}
+	span.SetAttributes(attribute.Int("expvar.samples", len(samples)))
+	return samples, read, nil
+}
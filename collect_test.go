@@ -0,0 +1,72 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"sort"
+	"testing"
+)
+
+func TestCollectMergePath(t *testing.T) {
+	target := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		switch req.URL.Path {
+		case "/metrics":
+			w.Header().Set("Content-Type", "text/plain; version=0.0.4")
+			fmt.Fprint(w, "# TYPE requests counter\nrequests 3\n"+
+				"# TYPE latency histogram\nlatency_bucket{le=\"+Inf\"} 2\nlatency_sum 0.5\nlatency_count 2\n")
+		case "/debug/vars":
+			fmt.Fprint(w, `{"requests": 5, "latency_count": 9, "goroutines": 12}`)
+		case "/debug/queues":
+			fmt.Fprint(w, `{"queued": 1}`)
+		default:
+			http.NotFound(w, req)
+		}
+	}))
+	defer target.Close()
+
+	tests := []struct {
+		name   string
+		config string
+		want   []string
+	}{
+		{
+			name:   "merge path",
+			config: "    merge_path: /debug/vars\n",
+			want:   []string{`goroutines{} 12`, `latency{} 0`, `requests{} 3`},
+		},
+		{
+			name:   "merge and extra paths",
+			config: "    merge_path: /debug/vars\n    extra_paths: [/debug/queues]\n",
+			want: []string{
+				`goroutines{path="/debug/vars"} 12`,
+				`latency{path="/metrics"} 0`,
+				`queued{path="/debug/queues"} 1`,
+				`requests{path="/metrics"} 3`,
+			},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			p := newTestProxy(t, fmt.Sprintf("targets:\n  - name: app\n    url: %s/metrics\n%s", target.URL, tt.config))
+			tc := p.Config().Targets[0]
+			samples, err := p.collect(context.Background(), http.DefaultClient, tc)
+			if err != nil {
+				t.Fatal(err)
+			}
+			var got []string
+			for _, s := range samples {
+				labels := ""
+				for _, l := range s.Labels {
+					labels += fmt.Sprintf("%s=%q", l.Name, l.Value)
+				}
+				got = append(got, fmt.Sprintf("%s{%s} %g", s.Name, labels, s.Value))
+			}
+			sort.Strings(got)
+			if fmt.Sprint(got) != fmt.Sprint(tt.want) {
+				t.Errorf("got %q, want %q", got, tt.want)
+			}
+		})
+	}
+}
@@ -0,0 +1,112 @@
+package main
+
+import (
+	"math"
+	"sync"
+	"time"
+
+	"github.com/relex/prometheus-expvar-proxy/expvarcollector"
+)
+
+// CounterDetector classifies metrics as counters by watching their values
+// across scrapes of the same target.
+//
+// A metric becomes a counter once it stays a non-negative integer that never
+// decreases for MinScrapes consecutive scrapes and has increased at least
+// once. The classification is sticky, so that metric names don't flip back
+// and forth; later decreases are treated as counter resets.
+type CounterDetector struct {
+	MinScrapes int
+
+	mu      sync.Mutex
+	targets map[string]*targetHistory
+}
+
+type targetHistory struct {
+	lastScrape time.Time
+	series     map[string]*seriesHistory
+	counters   map[string]bool // sticky classification by metric name
+}
+
+type seriesHistory struct {
+	last      float64
+	steady    int // consecutive scrapes without decrease
+	increased bool
+	counter   bool
+}
+
+// Observe records samples scraped from the target and returns the metric
+// names whose samples are all classified as counters.
+func (d *CounterDetector) Observe(target string, samples []sample) map[string]bool {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	now := time.Now()
+	if d.targets == nil {
+		d.targets = make(map[string]*targetHistory)
+	}
+	for key, th := range d.targets {
+		if now.Sub(th.lastScrape) > expvarcollector.TargetStateTTL {
+			delete(d.targets, key)
+		}
+	}
+
+	th := d.targets[target]
+	if th == nil {
+		th = &targetHistory{
+			series:   make(map[string]*seriesHistory, len(samples)),
+			counters: make(map[string]bool),
+		}
+		d.targets[target] = th
+	}
+	th.lastScrape = now
+
+	allCounters := make(map[string]bool)
+	seen := make(map[string]bool, len(samples))
+	for _, s := range samples {
+		if s.Histogram != nil || s.Summary != nil {
+			continue
+		}
+		key := expvarcollector.SeriesKey(s)
+		seen[key] = true
+		v := s.Value
+
+		sh := th.series[key]
+		if sh == nil {
+			th.series[key] = &seriesHistory{last: v}
+			allCounters[s.Name] = false
+			continue
+		}
+
+		switch {
+		case sh.counter:
+		case v < 0 || v != math.Trunc(v) || v < sh.last:
+			sh.steady = 0
+			sh.increased = false
+		default:
+			sh.steady++
+			sh.increased = sh.increased || v > sh.last
+			sh.counter = sh.increased && sh.steady >= d.MinScrapes
+		}
+		sh.last = v
+
+		if all, ok := allCounters[s.Name]; !ok || all {
+			allCounters[s.Name] = sh.counter
+		}
+	}
+	for key := range th.series {
+		if !seen[key] {
+			delete(th.series, key)
+		}
+	}
+	counters := make(map[string]bool, len(th.counters))
+	for name, all := range allCounters {
+		if all {
+			th.counters[name] = true
+		}
+		if th.counters[name] {
+			counters[name] = true
+		}
+	}
+	return counters
+}
@@ -0,0 +1,63 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func TestCounterDetectorObservesScrapesNotRequests(t *testing.T) {
+	var scrapes atomic.Int64
+	target := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		// The gauge increases once and then stays.
+		value := 1
+		if scrapes.Add(1) > 1 {
+			value = 2
+		}
+		fmt.Fprintf(w, `{"queue_length": %d}`, value)
+	}))
+	defer target.Close()
+
+	p := newTestProxy(t, fmt.Sprintf("targets:\n  - name: app\n    url: %s/debug/vars\n", target.URL))
+	p.Counters = &CounterDetector{MinScrapes: 3}
+	p.Cache = &ScrapeCache{TTL: time.Hour}
+	tc := p.Config().Targets[0]
+
+	// The first scrape is uncached.
+	if _, err := p.targetFamilies(testRequest(), tc, 0, nil); err != nil {
+		t.Fatal(err)
+	}
+	p.Cache.Reset()
+	for i := 0; i < 5; i++ {
+		families, err := p.targetFamilies(testRequest(), tc, 0, nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if findFamily(families, "queue_length") == nil {
+			t.Fatalf("request %d: queue_length was renamed, families: %v", i, families)
+		}
+	}
+	if n := scrapes.Load(); n != 2 {
+		t.Errorf("got %d scrapes of the target, want 2", n)
+	}
+}
+
+func TestCounterDetectorPromotesIncreasingMetrics(t *testing.T) {
+	d := &CounterDetector{MinScrapes: 3}
+	var counters map[string]bool
+	for i := 0; i < 4; i++ {
+		counters = d.Observe("app", []sample{
+			{Name: "requests", Value: float64(i * 10)},
+			{Name: "temperature", Value: 20.5},
+		})
+	}
+	if !counters["requests"] {
+		t.Error("requests wasn't detected as counter")
+	}
+	if counters["temperature"] {
+		t.Error("temperature was detected as counter")
+	}
+}
@@ -0,0 +1,37 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"os"
+	"strings"
+)
+
+// envPrefix is the prefix of environment variables setting flags.
+const envPrefix = "EXPVAR_EXPORTER_"
+
+// envName returns the environment variable of the flag name, e.g.
+// EXPVAR_EXPORTER_WEB_CONFIG_FILE for web.config.file.
+func envName(name string) string {
+	return envPrefix + strings.ToUpper(strings.NewReplacer(".", "_", "-", "_").Replace(name))
+}
+
+// setFlagsFromEnv sets the flags of fs that weren't given on the command line
+// from their environment variables, so that flags take precedence.
+func setFlagsFromEnv(fs *flag.FlagSet) error {
+	given := map[string]bool{}
+	fs.Visit(func(f *flag.Flag) {
+		given[f.Name] = true
+	})
+	var err error
+	fs.VisitAll(func(f *flag.Flag) {
+		value, ok := os.LookupEnv(envName(f.Name))
+		if !ok || given[f.Name] || err != nil {
+			return
+		}
+		if serr := fs.Set(f.Name, value); serr != nil {
+			err = fmt.Errorf("invalid value %q of %s: %w", value, envName(f.Name), serr)
+		}
+	})
+	return err
+}
@@ -0,0 +1,128 @@
+package main
+
+import (
+	"fmt"
+	"log/slog"
+	"net/http"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/relex/prometheus-expvar-proxy/expvarcollector"
+)
+
+// Exporter serves metrics of the targets listed in the config file, of one
+// target given by name, or of all of them merged.
+type Exporter struct {
+	Proxy *Proxy
+
+	// SingleUnlabeled serves the only target of the config without target
+	// and instance labels when no target is given, instead of merging it.
+	SingleUnlabeled bool
+}
+
+func (e *Exporter) ServeHTTP(wr http.ResponseWriter, req *http.Request) {
+	query := req.URL.Query()
+	timeout, err := parseTimeoutParam(query.Get("timeout"))
+	if err != nil {
+		e.Proxy.sendError(wr, http.StatusBadRequest, err)
+		return
+	}
+	if name := query.Get("target"); name == "" && !(e.SingleUnlabeled && len(e.Proxy.Config().Targets) == 1) {
+		e.serveAll(wr, req, timeout)
+		return
+	}
+	target, err := e.findTarget(query.Get("target"))
+	if err != nil {
+		e.Proxy.sendError(wr, http.StatusNotFound, err)
+		return
+	}
+	e.Proxy.serveTarget(wr, req, target, timeout)
+}
+
+// serveAll scrapes all configured targets concurrently and sends their
+// metrics merged into one exposition, where the series of each target are
+// labeled with its name as target and the host of its URL as instance,
+// unless the labels of the target set them.
+func (e *Exporter) serveAll(wr http.ResponseWriter, req *http.Request, timeout time.Duration) {
+	targets := e.Proxy.Config().Targets
+	results := make([][]metricFamily, len(targets))
+	errs := make([]error, len(targets))
+	var wg sync.WaitGroup
+	for i, t := range targets {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			results[i], errs[i] = e.Proxy.targetFamilies(req, t, timeout, aggregateLabels(t))
+		}()
+	}
+	wg.Wait()
+	for _, err := range errs {
+		if err != nil {
+			e.Proxy.sendError(wr, http.StatusServiceUnavailable, err)
+			return
+		}
+	}
+
+	families := append(mergeFamilies(results), buildInfoFamily())
+	if err := sendFamilies(wr, req, families, e.Proxy.NativeHistograms); err != nil {
+		slog.Warn("failed to send metrics of all targets", "err", err)
+	}
+}
+
+// aggregateLabels returns the labels of the target with target and instance
+// labels identifying it among all targets.
+func aggregateLabels(t *TargetConfig) []Label {
+	labels := append([]Label(nil), t.labels...)
+	if !hasLabel(labels, "target") {
+		labels = append(labels, Label{Name: "target", Value: t.Name})
+	}
+	if !hasLabel(labels, "instance") {
+		labels = append(labels, Label{Name: "instance", Value: t.parsedURL.Host})
+	}
+	expvarcollector.SortLabels(labels)
+	return labels
+}
+
+// mergeFamilies merges the families of several targets by name, keeping the
+// help and type of the first target having each, and sorts them by name and
+// their samples by labels.
+func mergeFamilies(lists [][]metricFamily) []metricFamily {
+	byName := make(map[string]*metricFamily)
+	var names []string
+	for _, families := range lists {
+		for _, mf := range families {
+			merged := byName[mf.Name]
+			if merged == nil {
+				merged = &metricFamily{Name: mf.Name, Help: mf.Help, Type: mf.Type}
+				byName[mf.Name] = merged
+				names = append(names, mf.Name)
+			}
+			merged.Samples = append(merged.Samples, mf.Samples...)
+		}
+	}
+	sort.Strings(names)
+	families := make([]metricFamily, len(names))
+	for i, name := range names {
+		families[i] = *byName[name]
+		expvarcollector.SortSamples(families[i].Samples)
+	}
+	return families
+}
+
+// findTarget looks up a configured target by name. The name may be omitted if
+// there is only one target, for SingleUnlabeled.
+func (e *Exporter) findTarget(name string) (*TargetConfig, error) {
+	cfg := e.Proxy.Config()
+	if name == "" {
+		if len(cfg.Targets) != 1 {
+			return nil, fmt.Errorf("missing target parameter")
+		}
+		return cfg.Targets[0], nil
+	}
+	target := cfg.Target(name)
+	if target == nil {
+		return nil, fmt.Errorf("unknown target %q", name)
+	}
+	return target, nil
+}
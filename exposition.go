@@ -0,0 +1,297 @@
+package main
+
+import (
+	"bufio"
+	"compress/gzip"
+	"io"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	dto "github.com/prometheus/client_model/go"
+	"github.com/prometheus/common/expfmt"
+	"github.com/relex/prometheus-expvar-proxy/expvarcollector"
+	"google.golang.org/protobuf/proto"
+)
+
+// metricFamily is a group of collected samples ready for exposition.
+type metricFamily struct {
+	Name    string
+	Help    string
+	Type    string
+	Samples []sample
+}
+
+// families groups the collected samples by name, applies metadata, the
+// counters detected when they were scraped and the metric prefix, and
+// returns them sorted by name and labels.
+func (p *Proxy) families(target *TargetConfig, samples []sample, counters map[string]bool) []metricFamily {
+	rules := target.rules(p.Config())
+	prefix := p.Prefix
+	if target.Prefix != "" {
+		prefix = target.Prefix
+	}
+
+	byName := make(map[string]*metricFamily, len(samples))
+	for _, s := range samples {
+		mf := byName[s.Name]
+		if mf == nil {
+			mf = &metricFamily{Name: s.Name}
+			byName[s.Name] = mf
+		}
+		mf.Samples = append(mf.Samples, s)
+	}
+
+	families := make([]metricFamily, 0, len(byName))
+	for name, mf := range byName {
+		m := rules.Metric(name)
+		if m == nil {
+			m = mf.Samples[0].Meta
+		}
+		if m == nil {
+			m = expvarcollector.GoMetric(name)
+		}
+		if m != nil {
+			mf.Help = m.Help
+			mf.Type = m.Type
+		} else if counters[name] {
+			if !strings.HasSuffix(name, "_total") {
+				mf.Name += "_total"
+				for i := range mf.Samples {
+					mf.Samples[i].Name = mf.Name
+				}
+			}
+			mf.Type = "counter"
+		}
+		if prefix != "" {
+			mf.Name = prefix + mf.Name
+			for i := range mf.Samples {
+				mf.Samples[i].Name = mf.Name
+			}
+		}
+		expvarcollector.SortSamples(mf.Samples)
+		families = append(families, *mf)
+	}
+	sort.Slice(families, func(i, j int) bool {
+		return families[i].Name < families[j].Name
+	})
+	return families
+}
+
+// roundValues rounds values, histogram sums, and summary sums and quantiles
+// to fixed decimal places, the same way as formatting them with
+// "%.<decimals>f".
+func roundValues(samples []sample, decimals int) {
+	round := func(v float64) float64 {
+		r, err := strconv.ParseFloat(strconv.FormatFloat(v, 'f', decimals, 64), 64)
+		if err != nil {
+			return v // NaN and infinities
+		}
+		return r
+	}
+	for i := range samples {
+		if h := samples[i].Histogram; h != nil {
+			h.Sum = round(h.Sum)
+		} else if sm := samples[i].Summary; sm != nil {
+			sm.Sum = round(sm.Sum)
+			for q, v := range sm.Quantiles {
+				sm.Quantiles[q] = round(v)
+			}
+		} else {
+			samples[i].Value = round(samples[i].Value)
+		}
+	}
+}
+
+// bufferedWriters pools the buffers of sendFamilies.
+var bufferedWriters = sync.Pool{
+	New: func() interface{} { return bufio.NewWriterSize(nil, 32<<10) },
+}
+
+// sendFamilies streams families to the response in the format negotiated by
+// the request, compressed if accepted. Errors can only be logged, as the
+// status has been sent already.
+func sendFamilies(wr http.ResponseWriter, req *http.Request, families []metricFamily, native bool) error {
+	format := expfmt.NegotiateIncludingOpenMetrics(req.Header)
+	wr.Header().Set("Content-Type", string(format))
+	wr.Header().Set("Vary", "Accept-Encoding")
+
+	var w io.Writer = wr
+	var gz *gzip.Writer
+	if gzipAccepted(req.Header) {
+		wr.Header().Set("Content-Encoding", "gzip")
+		gz = gzipWriters.Get().(*gzip.Writer)
+		gz.Reset(wr)
+		defer func() {
+			gz.Reset(nil)
+			gzipWriters.Put(gz)
+		}()
+		w = gz
+	}
+	bw := bufferedWriters.Get().(*bufio.Writer)
+	bw.Reset(w)
+	defer func() {
+		bw.Reset(nil)
+		bufferedWriters.Put(bw)
+	}()
+
+	wr.WriteHeader(http.StatusOK)
+	err := writeFamilies(bw, format, families, native)
+	if err == nil {
+		err = bw.Flush()
+	}
+	if err == nil && gz != nil {
+		err = gz.Close()
+	}
+	return err
+}
+
+// writeFamilies encodes families in the negotiated format. Names that are
+// not valid legacy names are escaped by the scheme of the format, or quoted
+// for "escaping=allow-utf-8". Synthesized histograms get native buckets in
+// addition to the classic ones if native is set, which only the protobuf
+// format can carry.
+func writeFamilies(w io.Writer, format expfmt.Format, families []metricFamily, native bool) error {
+	enc := expfmt.NewEncoder(w, format)
+	for _, mf := range families {
+		if err := enc.Encode(protoFamily(mf, native)); err != nil {
+			return err
+		}
+	}
+	if closer, ok := enc.(expfmt.Closer); ok {
+		return closer.Close()
+	}
+	return nil
+}
+
+// protoFamily converts a family into its protobuf message.
+func protoFamily(mf metricFamily, native bool) *dto.MetricFamily {
+	pf := &dto.MetricFamily{
+		Name:   proto.String(mf.Name),
+		Metric: make([]*dto.Metric, 0, len(mf.Samples)),
+	}
+	if mf.Help != "" {
+		pf.Help = proto.String(mf.Help)
+	}
+	switch mf.Type {
+	case "counter":
+		pf.Type = dto.MetricType_COUNTER.Enum()
+	case "gauge":
+		pf.Type = dto.MetricType_GAUGE.Enum()
+	case "histogram":
+		pf.Type = dto.MetricType_HISTOGRAM.Enum()
+	case "summary":
+		pf.Type = dto.MetricType_SUMMARY.Enum()
+	default:
+		pf.Type = dto.MetricType_UNTYPED.Enum()
+	}
+
+	for _, s := range mf.Samples {
+		m := &dto.Metric{Label: protoLabels(s.Labels)}
+		if s.TimestampMs != 0 {
+			m.TimestampMs = proto.Int64(s.TimestampMs)
+		}
+		switch {
+		case s.Histogram != nil:
+			h := &dto.Histogram{
+				SampleCount: proto.Uint64(s.Histogram.Count),
+				SampleSum:   proto.Float64(s.Histogram.Sum),
+				Bucket:      make([]*dto.Bucket, 0, len(s.Histogram.Bounds)),
+			}
+			for i, bound := range s.Histogram.Bounds {
+				h.Bucket = append(h.Bucket, &dto.Bucket{
+					UpperBound:      proto.Float64(bound),
+					CumulativeCount: proto.Uint64(s.Histogram.Counts[i]),
+				})
+			}
+			if native && s.Histogram.Native != nil {
+				addNativeBuckets(h, s.Histogram)
+			}
+			m.Histogram = h
+		case s.Summary != nil:
+			sm := &dto.Summary{
+				SampleCount: proto.Uint64(s.Summary.Count),
+				SampleSum:   proto.Float64(s.Summary.Sum),
+				Quantile:    make([]*dto.Quantile, 0, len(s.Summary.Quantiles)),
+			}
+			for q, v := range s.Summary.Quantiles {
+				sm.Quantile = append(sm.Quantile, &dto.Quantile{Quantile: proto.Float64(q), Value: proto.Float64(v)})
+			}
+			sort.Slice(sm.Quantile, func(i, j int) bool {
+				return sm.Quantile[i].GetQuantile() < sm.Quantile[j].GetQuantile()
+			})
+			m.Summary = sm
+		case mf.Type == "counter":
+			m.Counter = &dto.Counter{Value: proto.Float64(s.Value)}
+			if s.Exemplar != nil {
+				m.Counter.Exemplar = &dto.Exemplar{Label: protoLabels(s.Exemplar), Value: proto.Float64(s.ExemplarValue)}
+			}
+		case mf.Type == "gauge":
+			m.Gauge = &dto.Gauge{Value: proto.Float64(s.Value)}
+		default:
+			m.Untyped = &dto.Untyped{Value: proto.Float64(s.Value)}
+		}
+		pf.Metric = append(pf.Metric, m)
+	}
+	return pf
+}
+
+func protoLabels(labels []Label) []*dto.LabelPair {
+	pairs := make([]*dto.LabelPair, 0, len(labels))
+	for _, l := range labels {
+		pairs = append(pairs, &dto.LabelPair{Name: proto.String(l.Name), Value: proto.String(l.Value)})
+	}
+	return pairs
+}
+
+// addNativeBuckets adds the native buckets of hist to h.
+func addNativeBuckets(h *dto.Histogram, hist *expvarcollector.Histogram) {
+	h.Schema = proto.Int32(expvarcollector.NativeSchema)
+	h.ZeroThreshold = proto.Float64(expvarcollector.NativeZeroThreshold)
+	h.ZeroCount = proto.Uint64(hist.ZeroCount)
+
+	spans, deltas := hist.NativeBuckets()
+	h.PositiveSpan = make([]*dto.BucketSpan, 0, len(spans))
+	for _, span := range spans {
+		h.PositiveSpan = append(h.PositiveSpan, &dto.BucketSpan{
+			Offset: proto.Int32(int32(span.Offset)),
+			Length: proto.Uint32(uint32(span.Length)),
+		})
+	}
+	h.PositiveDelta = deltas
+}
+
+// scrapeFamilies returns expvar_up, expvar_scrape_duration_seconds and
+// expvar_scrape_samples_scraped, which describe the last scrape of the target,
+// so that failures show up as data.
+func scrapeFamilies(labels []Label, up bool, duration time.Duration, scraped int) []metricFamily {
+	labels = append([]Label(nil), labels...)
+	expvarcollector.SortLabels(labels)
+	upValue := 0.0
+	if up {
+		upValue = 1
+	}
+	return []metricFamily{
+		{
+			Name:    "expvar_scrape_duration_seconds",
+			Help:    "Duration of the last scrape of the target.",
+			Type:    "gauge",
+			Samples: []sample{{Name: "expvar_scrape_duration_seconds", Labels: labels, Value: duration.Seconds()}},
+		},
+		{
+			Name:    "expvar_scrape_samples_scraped",
+			Help:    "Number of samples exported from the target.",
+			Type:    "gauge",
+			Samples: []sample{{Name: "expvar_scrape_samples_scraped", Labels: labels, Value: float64(scraped)}},
+		},
+		{
+			Name:    "expvar_up",
+			Help:    "Whether the last scrape of the target was successful.",
+			Type:    "gauge",
+			Samples: []sample{{Name: "expvar_up", Labels: labels, Value: upValue}},
+		},
+	}
+}
@@ -0,0 +1,118 @@
+package expvarcollector
+
+import (
+	"encoding/json"
+	"fmt"
+	"math"
+	"strconv"
+)
+
+// Array modes of -arrays and "array" of path configs.
+const (
+	ArrayDrop      = "drop"      // arrays are not exported
+	ArrayIndex     = "index"     // name{index="0"} v0, name{index="1"} v1, ...
+	ArrayAggregate = "aggregate" // name_min, name_max, name_sum, name_avg and name_count
+)
+
+// CheckArrayMode validates an array mode.
+func CheckArrayMode(mode string) error {
+	switch mode {
+	case ArrayDrop, ArrayIndex, ArrayAggregate:
+		return nil
+	}
+	return fmt.Errorf("unknown array mode %q", mode)
+}
+
+// collectArray exports an array of objects if the path is configured with an
+// id_field, or an array of numbers or booleans according to the mode
+// configured for the path, or the global mode. Arrays of other values are
+// dropped.
+func (c *collector) collectArray(path []string, k string, labels []Label, v []interface{}) {
+	mode := c.ArrayMode
+	if pc := c.Rules.Path(path); pc != nil {
+		if pc.IDField != "" {
+			c.collectObjects(path, k, labels, pc, v)
+			return
+		}
+		if pc.Array != "" {
+			mode = pc.Array
+		}
+	}
+	if mode == ArrayDrop || mode == "" {
+		return
+	}
+	name := k
+
+	values := make([]float64, len(v))
+	for i, elem := range v {
+		switch elem := elem.(type) {
+		case json.Number, bool:
+			values[i] = valToFloat(elem)
+		default:
+			return
+		}
+	}
+
+	switch mode {
+	case ArrayIndex:
+		for i, f := range values {
+			elemLabels := append(labels[:len(labels):len(labels)], Label{Name: "index", Value: strconv.Itoa(i)})
+			c.addSample(name, elemLabels, f)
+		}
+	case ArrayAggregate:
+		c.addSample(name+"_count", labels, float64(len(values)))
+		if len(values) == 0 {
+			c.addSample(name+"_sum", labels, 0)
+			return
+		}
+		lo, hi, sum := values[0], values[0], 0.0
+		for _, f := range values {
+			lo = math.Min(lo, f)
+			hi = math.Max(hi, f)
+			sum += f
+		}
+		c.addSample(name+"_min", labels, lo)
+		c.addSample(name+"_max", labels, hi)
+		c.addSample(name+"_sum", labels, sum)
+		c.addSample(name+"_avg", labels, sum/float64(len(values)))
+	}
+}
+
+// collectObjects exports an array like [{"name": "a", "depth": 3}] as
+// k_depth{name="a"} 3.
+func (c *collector) collectObjects(path []string, k string, labels []Label, pc *PathConfig, v []interface{}) {
+	for _, elem := range v {
+		obj, ok := elem.(map[string]interface{})
+		if !ok {
+			continue
+		}
+		var id string
+		switch idv := obj[pc.IDField].(type) {
+		case string:
+			id = idv
+		case json.Number:
+			id = idv.String()
+		default:
+			continue
+		}
+
+		objLabels := append(labels[:len(labels):len(labels)], Label{Name: pc.IDLabel, Value: id})
+		c.withParent(obj, func() {
+			for field, fv := range obj {
+				if field == pc.IDField || (len(pc.ValueFields) > 0 && !contains(pc.ValueFields, field)) {
+					continue
+				}
+				c.collectMetrics(append(path[:len(path):len(path)], field), k+"_"+field, objLabels, fv)
+			}
+		})
+	}
+}
+
+func contains(list []string, s string) bool {
+	for _, elem := range list {
+		if elem == s {
+			return true
+		}
+	}
+	return false
+}
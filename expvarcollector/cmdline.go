@@ -0,0 +1,25 @@
+package expvarcollector
+
+import (
+	"strconv"
+	"strings"
+)
+
+// collectCmdline exports the standard "cmdline" expvar, the array of
+// os.Args, as expvar_cmdline_info{cmdline="..."} 1.
+func (c *collector) collectCmdline(labels []Label, args []interface{}) {
+	words := make([]string, 0, len(args))
+	for _, arg := range args {
+		s, ok := arg.(string)
+		if !ok {
+			return
+		}
+		// Quote arguments that would be ambiguous after joining.
+		if s == "" || strings.ContainsAny(s, " \t\n\"'\\") {
+			s = strconv.Quote(s)
+		}
+		words = append(words, s)
+	}
+	labels = append(labels[:len(labels):len(labels)], Label{Name: "cmdline", Value: strings.Join(words, " ")})
+	c.addSample("expvar_cmdline_info", labels, 1)
+}
@@ -0,0 +1,395 @@
+// Package expvarcollector translates the expvars of Go programs, as served
+// by expvar at /debug/vars, into Prometheus metrics.
+//
+// Collector implements prometheus.Collector for a target, and Decode
+// flattens a response of a target into samples for custom exporters.
+package expvarcollector
+
+import (
+	"bufio"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"net/url"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+var (
+	// ErrTargetInaccessible marks errors of requesting or reading responses
+	// of targets, as opposed to errors of their content.
+	ErrTargetInaccessible = errors.New("inaccessible target")
+
+	// ErrInvalidExpvars marks errors of decoding or converting the expvars
+	// of targets.
+	ErrInvalidExpvars = errors.New("invalid expvars")
+)
+
+// TargetStateTTL is how long the history of a target is kept after its last
+// scrape, to bound memory when many different URLs are proxied.
+const TargetStateTTL = time.Hour
+
+// Options configure how expvars are flattened into samples. The zero value
+// flattens all numbers and booleans and fails on non-ASCII names.
+type Options struct {
+	// Rules configure paths, renames, filters and metadata of metrics if
+	// non-nil.
+	Rules *Rules
+
+	// MaxBodySize limits the size of decompressed target responses if
+	// positive.
+	MaxBodySize int64
+
+	// MaxDepth and MaxSamples limit the nesting of expvars and the number of
+	// metrics per scrape, if positive. Scrapes exceeding them fail.
+	MaxDepth   int
+	MaxSamples int
+
+	// Names caches metric names if non-nil.
+	Names *NameCache
+
+	// GoMemstats enables translation of memstats into go_memstats_* metrics.
+	GoMemstats bool
+
+	// BySize enables go_memstats_by_size_* series from memstats.BySize.
+	BySize bool
+
+	// CmdlineInfo enables expvar_cmdline_info from the cmdline expvar.
+	CmdlineInfo bool
+
+	// NonASCII is the policy for non-ASCII characters in metric names. See
+	// CheckNonASCIIPolicy for the supported policies.
+	NonASCII string
+
+	// SnakeCase converts CamelCase names into snake_case.
+	SnakeCase bool
+
+	// Collisions is the mode to resolve metric name collisions. See
+	// CheckCollisionMode for the supported modes.
+	Collisions string
+
+	// ArrayMode sets how arrays are exported by default. See CheckArrayMode
+	// for the supported modes.
+	ArrayMode string
+
+	// StringKinds lists how string expvars are parsed by default. See
+	// ParseStringKinds for the supported kinds.
+	StringKinds []string
+
+	// GCPauses synthesizes go_gc_pause_seconds with GoMemstats if non-nil.
+	GCPauses *GCPauseTracker
+
+	// NonFinite is the policy for NaN and infinite values. See
+	// CheckNonFinitePolicy for the supported policies.
+	NonFinite string
+
+	// Converters take over the flattening of the values they match if
+	// non-nil.
+	Converters *ConverterRegistry
+
+	// Script translates the expvars before they are flattened if non-nil.
+	Script *Script
+
+	// Format is the format of responses. See CheckFormat for the supported
+	// formats. If empty, responses with the Content-Type of Prometheus
+	// metrics are passed through as FormatPrometheus, and others are
+	// FormatExpvar.
+	Format string
+}
+
+// Decode flattens the expvars in the body of a response of target,
+// decompressed according to its Content-Encoding. sizeHint is the number of
+// samples to expect, e.g. from the previous scrape. It returns the samples
+// and the number of decompressed bytes read.
+func Decode(resp *http.Response, target *url.URL, opts *Options, sizeHint int) ([]Sample, int64, error) {
+	if opts.Format == "" && isPrometheus(resp.Header) {
+		o := *opts
+		o.Format = FormatPrometheus
+		opts = &o
+	}
+
+	decoded, err := decodedBody(resp)
+	if err != nil {
+		return nil, 0, fmt.Errorf("%w; error decompressing body of %q: %w", ErrTargetInaccessible, target, err)
+	}
+	body := &bodyReader{r: decoded, limit: opts.MaxBodySize}
+
+	if sizeHint <= 0 {
+		sizeHint = 1000
+	}
+	c := &collector{
+		Options: opts,
+		target:  target.String(),
+		samples: make([]Sample, 0, sizeHint),
+	}
+	err = c.collectFormat(bufio.NewReader(body), resp.Header, target)
+	switch {
+	case errors.Is(body.err, errBodyTooLarge):
+		return nil, body.n, fmt.Errorf("body of %q exceeds the limit of %d bytes", target, opts.MaxBodySize)
+	case body.err != nil:
+		return nil, body.n, fmt.Errorf("%w; error reading body of %q: %w", ErrTargetInaccessible, target, body.err)
+	case c.err != nil:
+		return nil, body.n, fmt.Errorf("%w; error converting metrics from %q: %w", ErrInvalidExpvars, target, c.err)
+	case err != nil:
+		return nil, body.n, fmt.Errorf("%w; error unmarshalling JSON from %q: %v", ErrInvalidExpvars, target, err)
+	}
+	return resolveCollisions(target, c.samples, opts.Collisions), body.n, nil
+}
+
+// Label is a label pair of a sample.
+type Label struct {
+	Name  string
+	Value string
+}
+
+// SortLabels sorts labels by name.
+func SortLabels(labels []Label) {
+	sort.Slice(labels, func(i, j int) bool {
+		return labels[i].Name < labels[j].Name
+	})
+}
+
+// Sample is a single flattened expvar value.
+type Sample struct {
+	Name   string
+	Labels []Label
+	Value  float64
+
+	// Histogram is set instead of Value for synthesized histograms.
+	Histogram *Histogram
+
+	// Summary is set instead of Value for summaries, e.g. of Dropwizard
+	// timers.
+	Summary *Summary
+
+	// Exemplar labels, e.g. trace_id, exported along with counters, and the
+	// value of the observation of the exemplar.
+	Exemplar      []Label
+	ExemplarValue float64
+
+	// TimestampMs is the observation time in Unix milliseconds, or 0 to use
+	// the scrape time.
+	TimestampMs int64
+
+	// Meta declares the help and type of the metric if non-nil, e.g. as
+	// returned by a script. Rules take precedence.
+	Meta *MetricConfig
+
+	key string // flattened expvar key before sanitizing and renaming
+}
+
+// Summary is a summary with precomputed quantiles.
+type Summary struct {
+	Count     uint64
+	Sum       float64
+	Quantiles map[float64]float64 // values by quantile, e.g. 0.99
+}
+
+// SeriesKey identifies a sample by its name and labels.
+func SeriesKey(s Sample) string {
+	sb := &strings.Builder{}
+	sb.WriteString(s.Name)
+	for _, l := range s.Labels {
+		sb.WriteByte(0)
+		sb.WriteString(l.Name)
+		sb.WriteByte(0)
+		sb.WriteString(l.Value)
+	}
+	return sb.String()
+}
+
+// collector flattens decoded expvars into samples.
+type collector struct {
+	*Options
+	target  string
+	samples []Sample
+	err     error // first error that fails the scrape
+
+	// parent is the map holding the values being flattened, for
+	// expressions, and parentVars its conversion into CEL values.
+	parent     map[string]interface{}
+	parentVars map[string]interface{}
+}
+
+// collectMetrics flattens the expvar v found at path. k is the unsanitized
+// metric name built so far and labels are the labels taken from parent keys.
+func (c *collector) collectMetrics(path []string, k string, labels []Label, v interface{}) {
+	name := k
+	if c.tooDeep(path) {
+		return
+	}
+	if c.convert(path, k, labels, v) {
+		return
+	}
+
+	switch v := v.(type) {
+	case json.Number:
+		c.addValue(path, name, labels, valToFloat(v))
+	case bool:
+		c.addValue(path, name, labels, valToFloat(v))
+	case map[string]interface{}:
+		if c.GoMemstats && len(path) == 1 && path[0] == "memstats" {
+			c.collectMemstats(path, k, labels, v)
+			return
+		}
+		keyLabel := ""
+		var exemplar []Label
+		var exemplarValue float64
+		var timestamp int64
+		pc := c.Rules.Path(path)
+		if pc != nil {
+			keyLabel = pc.KeyLabel
+			exemplar, exemplarValue = parseExemplar(pc, v)
+			timestamp = timestampMs(pc, v)
+		}
+		start := len(c.samples)
+		c.withParent(v, func() {
+			for lk, lv := range v {
+				if pc.isFieldOfSubtree(lk) {
+					continue
+				}
+				lpath, lname, llabels := child(path, k, labels, keyLabel, lk)
+				c.collectMetrics(lpath, lname, llabels, lv)
+			}
+		})
+		c.annotate(start, exemplar, exemplarValue, timestamp)
+	case string:
+		c.collectString(path, name, labels, v)
+	case []interface{}:
+		switch {
+		case c.BySize && len(path) == 2 && path[0] == "memstats" && path[1] == "BySize":
+			c.collectBySize(labels, v)
+		case c.CmdlineInfo && len(path) == 1 && path[0] == "cmdline":
+			c.collectCmdline(labels, v)
+		default:
+			c.collectArray(path, k, labels, v)
+		}
+	default:
+		slog.Warn("unsupported type of expvar", "target", c.target, "name", name, "value", fmt.Sprintf("%#v", v))
+		return
+	}
+}
+
+// child returns the path, unsanitized name and labels of the value at key lk
+// of the map at path.
+func child(path []string, k string, labels []Label, keyLabel string, lk string) ([]string, string, []Label) {
+	lpath := append(path[:len(path):len(path)], lk)
+	switch {
+	case len(path) == 0:
+		return lpath, lk, labels
+	case keyLabel != "":
+		return lpath, k, append(labels[:len(labels):len(labels)], Label{Name: keyLabel, Value: lk})
+	default:
+		return lpath, k + "_" + lk, labels
+	}
+}
+
+// annotate sets the exemplar and timestamp of a map on the samples collected
+// from its subtree since start, unless they got their own.
+func (c *collector) annotate(start int, exemplar []Label, exemplarValue float64, timestamp int64) {
+	for i := start; i < len(c.samples); i++ {
+		s := &c.samples[i]
+		if s.Exemplar == nil {
+			s.Exemplar, s.ExemplarValue = exemplar, exemplarValue
+		}
+		if s.TimestampMs == 0 {
+			s.TimestampMs = timestamp
+		}
+	}
+}
+
+// tooDeep fails the scrape if path exceeds the depth limit.
+func (c *collector) tooDeep(path []string) bool {
+	if c.MaxDepth <= 0 || len(path) <= c.MaxDepth {
+		return false
+	}
+	c.fail(fmt.Errorf("expvars nested deeper than %d levels at %q", c.MaxDepth, strings.Join(path[:c.MaxDepth], ".")))
+	return true
+}
+
+// fail records the first error that fails the scrape.
+func (c *collector) fail(err error) {
+	if c.err == nil {
+		c.err = err
+	}
+}
+
+// addSample records a flattened value under its final metric name.
+func (c *collector) addSample(name string, labels []Label, v float64) {
+	c.add(Sample{Name: name, Labels: labels, Value: v})
+}
+
+// add records a sample after sanitizing, stripping, filtering and renaming
+// its name. Non-finite values are handled according to the policy.
+func (c *collector) add(s Sample) {
+	if s.Histogram == nil && s.Summary == nil {
+		v, ok := finiteValue(s.Value, c.NonFinite)
+		if !ok {
+			return
+		}
+		s.Value = v
+	}
+	name, err := c.Names.Get(s.Name, c.metricName)
+	if err != nil {
+		if !errors.Is(err, errDropMetric) {
+			c.fail(err)
+		}
+		return
+	}
+	if c.MaxSamples > 0 && len(c.samples) >= c.MaxSamples {
+		c.fail(fmt.Errorf("more than %d metrics", c.MaxSamples))
+		return
+	}
+	s.key = s.Name
+	s.Name = name
+	c.samples = append(c.samples, s)
+}
+
+// metricName returns the final name of the metric of the flattened key k, or
+// errDropMetric if the metric is to be dropped.
+func (c *collector) metricName(k string) (string, error) {
+	name, err := c.sanitize(k, c.SnakeCase)
+	if err != nil {
+		return "", err
+	}
+	name = c.Rules.StripPrefix(name)
+	if !c.Rules.Keep(name) {
+		return "", errDropMetric
+	}
+	if renamed := c.Rules.Rename(name); renamed != name {
+		return c.sanitize(renamed, false)
+	}
+	return name, nil
+}
+
+// sanitize returns the metric name for n according to the non-ASCII policy,
+// or errDropMetric if the metric is to be dropped. Other errors fail the
+// scrape, as with NonASCIIFail. CamelCase is converted if snakeCase is set.
+func (c *collector) sanitize(n string, snakeCase bool) (string, error) {
+	if snakeCase {
+		n = toSnakeCase(n)
+	}
+	return sanitizeMetricName(n, c.NonASCII)
+}
+
+// valToFloat converts a JSON number or bool into a sample value. Numbers out
+// of the range of float64 become infinities.
+func valToFloat(v interface{}) float64 {
+	switch v := v.(type) {
+	case json.Number:
+		f, _ := strconv.ParseFloat(string(v), 64)
+		return f
+	case float64:
+		return v
+	case bool:
+		if v {
+			return 1.0
+		}
+		return 0.0
+	}
+	panic(fmt.Sprintf("unexpected value type: %#v", v))
+}
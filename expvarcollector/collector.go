@@ -0,0 +1,155 @@
+package expvarcollector
+
+import (
+	"context"
+	"net/http"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+// DefaultTimeout limits the duration of scrapes of a Collector without a
+// Timeout.
+const DefaultTimeout = 10 * time.Second
+
+// Collector is a prometheus.Collector exporting the expvars of a target,
+// which is scraped on each collection. It is unchecked because the metrics
+// of targets are not known in advance.
+//
+// For example, to export the expvars of a program along with the metrics of
+// the exporter itself:
+//
+//	prometheus.MustRegister(expvarcollector.NewCollector("http://localhost:8080/debug/vars", nil))
+type Collector struct {
+	// URL of the expvars of the target.
+	URL string
+
+	// Client scrapes the target, or http.DefaultClient if nil.
+	Client *http.Client
+
+	// Timeout limits the duration of each scrape, so that a hung target
+	// doesn't block the gathering forever. It is DefaultTimeout if zero, and
+	// unlimited if negative.
+	Timeout time.Duration
+
+	// Prefix is prepended to all metric names.
+	Prefix string
+
+	// Options configure the flattening of expvars.
+	Options Options
+}
+
+// NewCollector returns a collector of the expvars at rawURL, flattened with
+// opts, or with the default options if nil. It panics if opts has invalid
+// rules, like prometheus.MustRegister.
+func NewCollector(rawURL string, opts *Options) *Collector {
+	c := &Collector{URL: rawURL}
+	if opts != nil {
+		c.Options = *opts
+	}
+	if c.Options.Rules != nil {
+		if err := c.Options.Rules.Compile(); err != nil {
+			panic(err)
+		}
+	}
+	return c
+}
+
+// Describe sends nothing, which makes the collector unchecked.
+func (c *Collector) Describe(chan<- *prometheus.Desc) {}
+
+// Collect scrapes the target and sends its metrics. A failed scrape is
+// sent as an invalid metric, which fails the gathering.
+func (c *Collector) Collect(ch chan<- prometheus.Metric) {
+	samples, err := c.scrape()
+	if err != nil {
+		desc := prometheus.NewDesc(c.Prefix+"expvar_up", "Whether the expvars of the target were scraped.", nil, nil)
+		ch <- prometheus.NewInvalidMetric(desc, err)
+		return
+	}
+	for _, s := range samples {
+		m, err := c.metric(s)
+		if err != nil {
+			m = prometheus.NewInvalidMetric(prometheus.NewInvalidDesc(err), err)
+		}
+		ch <- m
+	}
+}
+
+func (c *Collector) scrape() ([]Sample, error) {
+	client := c.Client
+	if client == nil {
+		client = http.DefaultClient
+	}
+	timeout := c.Timeout
+	if timeout == 0 {
+		timeout = DefaultTimeout
+	}
+	ctx := context.Background()
+	if timeout > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, timeout)
+		defer cancel()
+	}
+	return fetch(ctx, client, c.URL, &c.Options)
+}
+
+// metric converts the sample into a constant metric, typed by the declared
+// metadata.
+func (c *Collector) metric(s Sample) (prometheus.Metric, error) {
+	var help string
+	valueType := prometheus.UntypedValue
+	if m := metricConfig(c.Options.Rules, s); m != nil {
+		help = m.Help
+		switch m.Type {
+		case "counter":
+			valueType = prometheus.CounterValue
+		case "gauge":
+			valueType = prometheus.GaugeValue
+		}
+	}
+
+	names := make([]string, len(s.Labels))
+	values := make([]string, len(s.Labels))
+	for i, l := range s.Labels {
+		names[i] = l.Name
+		values[i] = l.Value
+	}
+	desc := prometheus.NewDesc(c.Prefix+s.Name, help, names, nil)
+
+	var metric prometheus.Metric
+	var err error
+	switch {
+	case s.Histogram != nil:
+		buckets := make(map[float64]uint64, len(s.Histogram.Bounds))
+		for i, bound := range s.Histogram.Bounds {
+			buckets[bound] = s.Histogram.Counts[i]
+		}
+		metric, err = prometheus.NewConstHistogram(desc, s.Histogram.Count, s.Histogram.Sum, buckets, values...)
+	case s.Summary != nil:
+		metric, err = prometheus.NewConstSummary(desc, s.Summary.Count, s.Summary.Sum, s.Summary.Quantiles, values...)
+	default:
+		metric, err = prometheus.NewConstMetric(desc, valueType, s.Value, values...)
+		if err == nil && valueType == prometheus.CounterValue && s.Exemplar != nil {
+			metric, err = prometheus.NewMetricWithExemplars(metric, prometheus.Exemplar{
+				Value:  s.ExemplarValue,
+				Labels: labelMap(s.Exemplar),
+			})
+		}
+	}
+	if err != nil {
+		return nil, err
+	}
+	if s.TimestampMs != 0 {
+		metric = prometheus.NewMetricWithTimestamp(time.UnixMilli(s.TimestampMs), metric)
+	}
+	return metric, nil
+}
+
+func labelMap(labels []Label) prometheus.Labels {
+	m := make(prometheus.Labels, len(labels))
+	for _, l := range labels {
+		m[l.Name] = l.Value
+	}
+	return m
+}
@@ -0,0 +1,87 @@
+package expvarcollector
+
+import (
+	"fmt"
+	"log/slog"
+	"net/url"
+	"sort"
+	"strconv"
+)
+
+// Modes of -names.collisions, resolving different expvar keys that end up as
+// the same series, e.g. "foo-bar" and "foo/bar" as "foo_bar".
+const (
+	CollisionSuffix = "suffix" // foo_bar, foo_bar_2, ...
+	CollisionLabel  = "label"  // foo_bar{expvar_key="foo-bar"}, foo_bar{expvar_key="foo/bar"}
+)
+
+// collisionLabel holds the original expvar key with CollisionLabel.
+const collisionLabel = "expvar_key"
+
+// CheckCollisionMode validates a collision mode.
+func CheckCollisionMode(mode string) error {
+	switch mode {
+	case CollisionSuffix, CollisionLabel:
+		return nil
+	}
+	return fmt.Errorf("unknown collision mode %q", mode)
+}
+
+// resolveCollisions logs and disambiguates samples of the same series coming
+// from different expvar keys. Keys are sorted so that the result stays the
+// same across scrapes, and with CollisionSuffix the first key keeps the name,
+// preferring a key that didn't need sanitizing. Suffixes skip names that are
+// taken already, e.g. by an expvar named foo_bar_2.
+func resolveCollisions(target *url.URL, samples []Sample, mode string) []Sample {
+	bySeries := make(map[string][]int, len(samples))
+	var collisions []string
+	for i, s := range samples {
+		key := SeriesKey(s)
+		bySeries[key] = append(bySeries[key], i)
+		if len(bySeries[key]) == 2 {
+			collisions = append(collisions, key)
+		}
+	}
+	if len(collisions) == 0 {
+		return samples
+	}
+	sort.Strings(collisions)
+
+	for _, series := range collisions {
+		indexes := bySeries[series]
+		sort.Slice(indexes, func(i, j int) bool {
+			a, b := samples[indexes[i]], samples[indexes[j]]
+			if (a.key == a.Name) != (b.key == b.Name) {
+				return a.key == a.Name
+			}
+			return a.key < b.key
+		})
+
+		keys := make([]string, len(indexes))
+		for i, idx := range indexes {
+			keys[i] = samples[idx].key
+		}
+		slog.Warn("metric name collision", "target", target.Redacted(), "keys", keys, "metric", samples[indexes[0]].Name)
+
+		for i, idx := range indexes {
+			s := &samples[idx]
+			switch mode {
+			case CollisionLabel:
+				s.Labels = append(s.Labels[:len(s.Labels):len(s.Labels)], Label{Name: collisionLabel, Value: s.key})
+			default:
+				if i == 0 {
+					continue
+				}
+				name := s.Name
+				for n := i + 1; ; n++ {
+					s.Name = name + "_" + strconv.Itoa(n)
+					if _, taken := bySeries[SeriesKey(*s)]; !taken {
+						break
+					}
+				}
+				bySeries[SeriesKey(*s)] = []int{idx}
+			}
+		}
+	}
+	return samples
+}
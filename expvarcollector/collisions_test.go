@@ -0,0 +1,97 @@
+package expvarcollector
+
+import (
+	"bytes"
+	"io"
+	"net/http"
+	"net/url"
+	"sort"
+	"strconv"
+	"strings"
+	"testing"
+)
+
+// decodeString flattens the expvars in the JSON with opts.
+func decodeString(t *testing.T, body string, opts *Options) []Sample {
+	t.Helper()
+	target, _ := url.Parse("http://localhost:8080/debug/vars")
+	resp := &http.Response{
+		Header: http.Header{"Content-Type": {"application/json"}},
+		Body:   io.NopCloser(bytes.NewReader([]byte(body))),
+	}
+	samples, _, err := Decode(resp, target, opts, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return samples
+}
+
+// seriesStrings returns the samples as sorted "name{labels} value" strings.
+func seriesStrings(samples []Sample) []string {
+	series := make([]string, len(samples))
+	for i, s := range samples {
+		var labels []string
+		for _, l := range s.Labels {
+			labels = append(labels, l.Name+"="+l.Value)
+		}
+		series[i] = s.Name + "{" + strings.Join(labels, ",") + "} " + strconv.FormatFloat(s.Value, 'g', -1, 64)
+	}
+	sort.Strings(series)
+	return series
+}
+
+func TestResolveCollisions(t *testing.T) {
+	tests := []struct {
+		name string
+		mode string
+		body string
+		want []string
+	}{
+		{
+			name: "suffix",
+			mode: CollisionSuffix,
+			body: `{"foo_bar": 1, "foo-bar": 2}`,
+			want: []string{"foo_bar{} 1", "foo_bar_2{} 2"},
+		},
+		{
+			name: "suffix prefers unsanitized key",
+			mode: CollisionSuffix,
+			body: `{"foo-bar": 2, "foo_bar": 1}`,
+			want: []string{"foo_bar{} 1", "foo_bar_2{} 2"},
+		},
+		{
+			name: "suffix skips taken names",
+			mode: CollisionSuffix,
+			body: `{"foo-bar": 1, "foo.bar": 2, "foo_bar_2": 3}`,
+			want: []string{"foo_bar{} 1", "foo_bar_2{} 3", "foo_bar_3{} 2"},
+		},
+		{
+			name: "suffix skips names taken by suffixes",
+			mode: CollisionSuffix,
+			body: `{"foo-bar": 1, "foo.bar": 2, "foo bar": 3, "foo_bar_3": 4}`,
+			want: []string{"foo_bar{} 3", "foo_bar_2{} 1", "foo_bar_3{} 4", "foo_bar_4{} 2"},
+		},
+		{
+			name: "label",
+			mode: CollisionLabel,
+			body: `{"foo-bar": 1, "foo.bar": 2, "foo_bar_2": 3}`,
+			want: []string{"foo_bar_2{} 3", "foo_bar{expvar_key=foo-bar} 1", "foo_bar{expvar_key=foo.bar} 2"},
+		},
+		{
+			name: "no collision",
+			mode: CollisionSuffix,
+			body: `{"foo-bar": 1, "foo_baz": 2}`,
+			want: []string{"foo_bar{} 1", "foo_baz{} 2"},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			samples := decodeString(t, tt.body, &Options{Collisions: tt.mode})
+			got := seriesStrings(samples)
+			sort.Strings(tt.want)
+			if strings.Join(got, "\n") != strings.Join(tt.want, "\n") {
+				t.Errorf("got\n%s\nwant\n%s", strings.Join(got, "\n"), strings.Join(tt.want, "\n"))
+			}
+		})
+	}
+}
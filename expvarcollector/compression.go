@@ -0,0 +1,43 @@
+package expvarcollector
+
+import (
+	"bufio"
+	"compress/flate"
+	"compress/gzip"
+	"compress/zlib"
+	"fmt"
+	"io"
+	"net/http"
+	"strings"
+)
+
+// AcceptEncoding is sent to targets. Setting it disables the transparent gzip
+// support of http.Transport, so that deflate can be handled as well.
+const AcceptEncoding = "gzip, deflate"
+
+// decodedBody returns the body of a target response decompressed according to
+// its Content-Encoding.
+func decodedBody(resp *http.Response) (io.Reader, error) {
+	switch coding := strings.ToLower(strings.TrimSpace(resp.Header.Get("Content-Encoding"))); coding {
+	case "", "identity":
+		return resp.Body, nil
+	case "gzip", "x-gzip":
+		return gzip.NewReader(resp.Body)
+	case "deflate":
+		// "deflate" should be zlib-wrapped, but some servers send raw
+		// deflate data instead.
+		br := bufio.NewReader(resp.Body)
+		if header, err := br.Peek(2); err == nil && isZlibHeader(header) {
+			return zlib.NewReader(br)
+		}
+		return flate.NewReader(br), nil
+	default:
+		return nil, fmt.Errorf("unsupported Content-Encoding %q", coding)
+	}
+}
+
+// isZlibHeader reports whether b starts with a zlib header using the deflate
+// compression method.
+func isZlibHeader(b []byte) bool {
+	return b[0]&0x0f == 8 && (uint16(b[0])<<8|uint16(b[1]))%31 == 0
+}
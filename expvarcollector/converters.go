@@ -0,0 +1,186 @@
+package expvarcollector
+
+import (
+	"encoding/json"
+	"fmt"
+	"path"
+	"strings"
+	"sync"
+)
+
+// Kind is the JSON type of an expvar.
+type Kind string
+
+// Kinds of expvars. KindAny matches all of them.
+const (
+	KindAny    Kind = ""
+	KindNumber Kind = "number"
+	KindBool   Kind = "bool"
+	KindString Kind = "string"
+	KindArray  Kind = "array"
+	KindObject Kind = "object"
+)
+
+// kindOf returns the kind of a decoded JSON value.
+func kindOf(v interface{}) Kind {
+	switch v.(type) {
+	case json.Number, float64:
+		return KindNumber
+	case bool:
+		return KindBool
+	case string:
+		return KindString
+	case []interface{}:
+		return KindArray
+	case map[string]interface{}:
+		return KindObject
+	}
+	return KindAny
+}
+
+// Value is an expvar being flattened, as passed to converters.
+type Value struct {
+	// Path is the list of expvar keys from the root to the value.
+	Path []string
+
+	// Name is the unsanitized metric name built from the keys so far, e.g.
+	// "logs-agent_BytesSent".
+	Name string
+
+	// Labels are taken from the keys of parents, e.g. by key_label.
+	Labels []Label
+
+	// Value is the decoded JSON value: json.Number, bool, string,
+	// []interface{} or map[string]interface{}.
+	Value interface{}
+}
+
+// Kind returns the JSON type of the value.
+func (v *Value) Kind() Kind {
+	return kindOf(v.Value)
+}
+
+// Converter converts expvars into samples, taking over from the built-in
+// flattening for the values it matches. The root object of the expvars is
+// not passed to converters, and with converters registered the expvars are
+// decoded one top-level key at a time instead of being streamed.
+type Converter interface {
+	// Match reports whether the converter handles the value.
+	Match(v *Value) bool
+
+	// Convert returns the samples of the value, none to drop it. Samples
+	// without name get the name of the value. Their names are sanitized,
+	// filtered and renamed like those of other metrics. An error fails the
+	// scrape.
+	Convert(v *Value) ([]Sample, error)
+}
+
+// ConverterRegistry is an ordered list of converters, of which the first
+// matching a value converts it. It is a Converter itself, so registries can
+// be nested. It is safe for concurrent use.
+type ConverterRegistry struct {
+	mu         sync.RWMutex
+	converters []Converter
+}
+
+// Register adds the converter after those registered before.
+func (r *ConverterRegistry) Register(c Converter) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.converters = append(r.converters, c)
+}
+
+// Len returns the number of registered converters.
+func (r *ConverterRegistry) Len() int {
+	if r == nil {
+		return 0
+	}
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+	return len(r.converters)
+}
+
+// Lookup returns the first converter matching the value, or nil.
+func (r *ConverterRegistry) Lookup(v *Value) Converter {
+	if r == nil {
+		return nil
+	}
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+	for _, c := range r.converters {
+		if c.Match(v) {
+			return c
+		}
+	}
+	return nil
+}
+
+// Match reports whether a registered converter matches the value.
+func (r *ConverterRegistry) Match(v *Value) bool {
+	return r.Lookup(v) != nil
+}
+
+// Convert converts the value with the first matching converter, or drops it
+// if there is none.
+func (r *ConverterRegistry) Convert(v *Value) ([]Sample, error) {
+	if conv := r.Lookup(v); conv != nil {
+		return conv.Convert(v)
+	}
+	return nil, nil
+}
+
+// NewConverter returns a converter of the values of kind at paths matching
+// pattern, a dot-separated list of expvar keys where each element may be a
+// glob pattern, like the paths of rules. An empty pattern matches all
+// paths.
+func NewConverter(pattern string, kind Kind, convert func(v *Value) ([]Sample, error)) (Converter, error) {
+	fc := &funcConverter{kind: kind, convert: convert}
+	if pattern != "" {
+		fc.pattern = strings.Split(pattern, ".")
+		for _, elem := range fc.pattern {
+			if _, err := path.Match(elem, ""); err != nil {
+				return nil, fmt.Errorf("converter path %q: invalid pattern %q: %w", pattern, elem, err)
+			}
+		}
+	}
+	return fc, nil
+}
+
+type funcConverter struct {
+	pattern []string
+	kind    Kind
+	convert func(v *Value) ([]Sample, error)
+}
+
+func (fc *funcConverter) Match(v *Value) bool {
+	if fc.kind != KindAny && v.Kind() != fc.kind {
+		return false
+	}
+	return fc.pattern == nil || matchPattern(fc.pattern, v.Path)
+}
+
+func (fc *funcConverter) Convert(v *Value) ([]Sample, error) {
+	return fc.convert(v)
+}
+
+// convert flattens the value with the first matching converter of the
+// options, and reports whether there was one.
+func (c *collector) convert(path []string, k string, labels []Label, v interface{}) bool {
+	value := &Value{Path: path, Name: k, Labels: labels, Value: v}
+	conv := c.Converters.Lookup(value)
+	if conv == nil {
+		return false
+	}
+	samples, err := conv.Convert(value)
+	if err != nil {
+		c.fail(fmt.Errorf("error converting %q: %w", strings.Join(path, "."), err))
+		return true
+	}
+	for _, s := range samples {
+		if s.Name == "" {
+			s.Name = k
+		}
+		c.add(s)
+	}
+	return true
+}
@@ -0,0 +1,201 @@
+package expvarcollector
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+)
+
+var errBodyTooLarge = errors.New("body too large")
+
+// bodyReader records the first error reading a target response, other than
+// io.EOF, and fails with errBodyTooLarge after limit bytes if limit is
+// positive.
+type bodyReader struct {
+	r     io.Reader
+	limit int64
+	n     int64
+	err   error
+}
+
+func (b *bodyReader) Read(p []byte) (int, error) {
+	if b.err != nil {
+		return 0, b.err
+	}
+	n, err := b.r.Read(p)
+	b.n += int64(n)
+	if b.limit > 0 && b.n > b.limit {
+		b.err = errBodyTooLarge
+		return n, b.err
+	}
+	if err != nil && err != io.EOF {
+		b.err = err
+	}
+	return n, err
+}
+
+// hexEscapeReplacer replaces "\xNN" with "?" in the stream, as in the regular
+// expression `\\x..`.
+type hexEscapeReplacer struct {
+	r *bufio.Reader
+}
+
+func (h *hexEscapeReplacer) Read(p []byte) (int, error) {
+	n := 0
+	for n < len(p) {
+		if n > 0 && h.r.Buffered() == 0 {
+			break // don't block on a partially received body
+		}
+		if _, err := h.r.Peek(1); err != nil {
+			if n > 0 {
+				break
+			}
+			return 0, err
+		}
+
+		// Copy everything up to the next backslash at once.
+		chunk, _ := h.r.Peek(h.r.Buffered())
+		if i := bytes.IndexByte(chunk, '\\'); i != 0 {
+			if i > 0 {
+				chunk = chunk[:i]
+			}
+			m := copy(p[n:], chunk)
+			h.r.Discard(m)
+			n += m
+			continue
+		}
+
+		if esc, err := h.r.Peek(4); err == nil && esc[1] == 'x' && esc[2] != '\n' && esc[3] != '\n' {
+			h.r.Discard(len(esc))
+			p[n] = '?'
+		} else {
+			h.r.Discard(1)
+			p[n] = '\\'
+		}
+		n++
+	}
+	return n, nil
+}
+
+// collectStream flattens the expvar object read from dec while it is being
+// decoded, so that neither the whole body nor the whole decoded object need
+// to be held in memory. Subtrees that are only flattened as a whole, like
+// arrays and memstats, are decoded first and passed to collectMetrics.
+//
+// It stops at the first error of decoding or of the collector.
+func (c *collector) collectStream(dec *json.Decoder) error {
+	tok, err := dec.Token()
+	if err == nil && tok != json.Delim('{') {
+		return fmt.Errorf("expvars must be a JSON object")
+	}
+	if err == nil {
+		err = c.streamMap(dec, nil, "", nil)
+	}
+	if err == io.EOF {
+		// The decoder only returns io.EOF between values.
+		return io.ErrUnexpectedEOF
+	}
+	return err
+}
+
+// streamMetrics flattens the value read next from dec like collectMetrics.
+func (c *collector) streamMetrics(dec *json.Decoder, path []string, k string, labels []Label) error {
+	if c.tooDeep(path) {
+		return c.err
+	}
+	if c.GoMemstats && len(path) == 1 && path[0] == "memstats" {
+		return c.decodeMetrics(dec, path, k, labels)
+	}
+	if c.Converters.Len() > 0 || c.Rules.exprParent(path) || c.Rules.extracts(path) {
+		// Converters may match whole objects, expressions may refer to the
+		// parent of values, and JSONPaths may select values anywhere in the
+		// subtree, which have to be decoded first.
+		return c.decodeMetrics(dec, path, k, labels)
+	}
+
+	tok, err := dec.Token()
+	if err != nil {
+		return err
+	}
+	switch tok {
+	case json.Delim('{'):
+		return c.streamMap(dec, path, k, labels)
+	case json.Delim('['):
+		var elems []interface{}
+		for dec.More() {
+			var elem interface{}
+			if err := dec.Decode(&elem); err != nil {
+				return err
+			}
+			elems = append(elems, elem)
+		}
+		if _, err := dec.Token(); err != nil {
+			return err
+		}
+		if elems == nil {
+			elems = []interface{}{}
+		}
+		c.collectMetrics(path, k, labels, elems)
+	default:
+		c.collectMetrics(path, k, labels, tok)
+	}
+	return c.err
+}
+
+// streamMap flattens the rest of a map after its opening brace. Fields
+// holding the exemplar or timestamp of the subtree are kept until the end of
+// the map.
+func (c *collector) streamMap(dec *json.Decoder, path []string, k string, labels []Label) error {
+	keyLabel := ""
+	pc := c.Rules.Path(path)
+	if pc != nil {
+		keyLabel = pc.KeyLabel
+	}
+	fields := make(map[string]interface{})
+
+	start := len(c.samples)
+	for dec.More() {
+		tok, err := dec.Token()
+		if err != nil {
+			return err
+		}
+		lk := tok.(string)
+		if pc.isFieldOfSubtree(lk) {
+			var v interface{}
+			if err := dec.Decode(&v); err != nil {
+				return err
+			}
+			fields[lk] = v
+			continue
+		}
+		lpath, lname, llabels := child(path, k, labels, keyLabel, lk)
+		if err := c.streamMetrics(dec, lpath, lname, llabels); err != nil {
+			return err
+		}
+	}
+	if _, err := dec.Token(); err != nil {
+		return err
+	}
+	if pc != nil {
+		exemplar, exemplarValue := parseExemplar(pc, fields)
+		c.annotate(start, exemplar, exemplarValue, timestampMs(pc, fields))
+	}
+	return nil
+}
+
+// decodeMetrics decodes the value read next from dec as a whole and
+// flattens it with collectMetrics.
+func (c *collector) decodeMetrics(dec *json.Decoder, path []string, k string, labels []Label) error {
+	var v interface{}
+	if err := dec.Decode(&v); err != nil {
+		return err
+	}
+	if len(path) == 1 {
+		c.extract(path[0], v)
+	}
+	c.collectMetrics(path, k, labels, v)
+	return c.err
+}
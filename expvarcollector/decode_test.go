@@ -0,0 +1,160 @@
+package expvarcollector
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"strings"
+	"testing"
+	"testing/iotest"
+)
+
+func TestHexEscapeReplacer(t *testing.T) {
+	tests := []struct {
+		name string
+		in   string
+		want string
+	}{
+		{"none", `{"a": "b\n"}`, `{"a": "b\n"}`},
+		{"valid", `"a\x41b"`, `"a?b"`},
+		{"several", `\x00\xff\xZZ`, `???`},
+		{"mixed", `"\t\x41\u0041\\"`, `"\t?\u0041\\"`},
+		{"escaped backslash", `\\x41`, `\?`}, // like the regular expression
+		{"truncated at end", `"a\x4`, `"a\x4`},
+		{"only prefix at end", `a\x`, `a\x`},
+		{"backslash at end", `a\`, `a\`},
+		{"newline in escape", "\\x4\n1", "\\x4\n1"},
+		{"newline after x", "\\x\n41", "\\x\n41"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			for _, reader := range []struct {
+				name string
+				r    io.Reader
+			}{
+				{"whole", strings.NewReader(tt.in)},
+				{"one byte", iotest.OneByteReader(strings.NewReader(tt.in))},
+			} {
+				got, err := io.ReadAll(&hexEscapeReplacer{r: bufio.NewReader(reader.r)})
+				if err != nil {
+					t.Fatal(err)
+				}
+				if string(got) != tt.want {
+					t.Errorf("%s: got %q, want %q", reader.name, got, tt.want)
+				}
+			}
+		})
+	}
+}
+
+// benchmarkPayload returns expvars like those of a busy daemon: memstats,
+// the cmdline, and nested maps of counters, some with hex escapes in their
+// keys.
+func benchmarkPayload() []byte {
+	vars := map[string]interface{}{
+		"cmdline": []string{"/usr/bin/daemon", "-config", "/etc/daemon.yml"},
+		"memstats": map[string]interface{}{
+			"Alloc": 123456, "TotalAlloc": 987654321, "Sys": 45678901,
+			"Mallocs": 1234567, "Frees": 1234000, "HeapAlloc": 123456,
+			"HeapObjects": 5678, "NumGC": 42, "PauseTotalNs": 1234567,
+		},
+	}
+	for i := 0; i < 20; i++ {
+		endpoints := make(map[string]interface{})
+		for j := 0; j < 50; j++ {
+			endpoints[fmt.Sprintf("Endpoint%d\\x2fv%d", j, i)] = map[string]interface{}{
+				"RequestsTotal": i * j,
+				"ErrorsTotal":   j,
+				"LatencyMs":     float64(i*j) / 7,
+			}
+		}
+		vars[fmt.Sprintf("service_%d", i)] = endpoints
+	}
+	payload, err := json.Marshal(vars)
+	if err != nil {
+		panic(err)
+	}
+	// json.Marshal escapes the backslashes, which daemons don't.
+	return bytes.ReplaceAll(payload, []byte(`\\x`), []byte(`\x`))
+}
+
+func TestDecodeCachedNames(t *testing.T) {
+	payload := benchmarkPayload()
+	target, _ := url.Parse("http://localhost:8080/debug/vars")
+	decode := func(opts *Options, sizeHint int) []string {
+		resp := &http.Response{
+			Header: http.Header{"Content-Type": {"application/json"}},
+			Body:   io.NopCloser(bytes.NewReader(payload)),
+		}
+		samples, _, err := Decode(resp, target, opts, sizeHint)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return seriesStrings(samples)
+	}
+
+	want := decode(&Options{CmdlineInfo: true}, 0)
+	tests := []struct {
+		name     string
+		names    *NameCache
+		sizeHint int
+	}{
+		{"size hint", nil, len(want)},
+		{"small size hint", nil, 1},
+		{"cache", &NameCache{Size: 100000}, 0},
+		{"evicting cache", &NameCache{Size: 10}, len(want)},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			opts := &Options{CmdlineInfo: true, Names: tt.names}
+			// The second scrape uses the names cached by the first.
+			for scrape := 1; scrape <= 2; scrape++ {
+				if got := decode(opts, tt.sizeHint); strings.Join(got, "\n") != strings.Join(want, "\n") {
+					t.Errorf("scrape %d: got %d series different from %d uncached ones", scrape, len(got), len(want))
+				}
+			}
+		})
+	}
+}
+
+func BenchmarkDecode(b *testing.B) {
+	payload := benchmarkPayload()
+	target, _ := url.Parse("http://localhost:8080/debug/vars")
+	decode := func(b *testing.B, opts *Options, sizeHint int) int {
+		resp := &http.Response{
+			Header: http.Header{"Content-Type": {"application/json"}},
+			Body:   io.NopCloser(bytes.NewReader(payload)),
+		}
+		samples, _, err := Decode(resp, target, opts, sizeHint)
+		if err != nil {
+			b.Fatal(err)
+		}
+		return len(samples)
+	}
+
+	b.Run("cold", func(b *testing.B) {
+		opts := &Options{CmdlineInfo: true}
+		b.ReportAllocs()
+		b.SetBytes(int64(len(payload)))
+		for i := 0; i < b.N; i++ {
+			decode(b, opts, 0)
+		}
+	})
+
+	// Configured targets keep the names and the number of samples of the
+	// previous scrape.
+	b.Run("cached", func(b *testing.B) {
+		opts := &Options{CmdlineInfo: true, Names: &NameCache{Size: 100000}}
+		sizeHint := decode(b, opts, 0)
+		b.ReportAllocs()
+		b.SetBytes(int64(len(payload)))
+		b.ResetTimer()
+		for i := 0; i < b.N; i++ {
+			decode(b, opts, sizeHint)
+		}
+	})
+}
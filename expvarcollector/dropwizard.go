@@ -0,0 +1,121 @@
+package expvarcollector
+
+import (
+	"encoding/json"
+	"fmt"
+	"sort"
+)
+
+// dropwizardMetrics is the response of the metrics servlet of Dropwizard.
+type dropwizardMetrics struct {
+	Gauges     map[string]map[string]interface{} `json:"gauges"`
+	Counters   map[string]map[string]interface{} `json:"counters"`
+	Histograms map[string]map[string]interface{} `json:"histograms"`
+	Meters     map[string]map[string]interface{} `json:"meters"`
+	Timers     map[string]map[string]interface{} `json:"timers"`
+}
+
+// dropwizardQuantiles are the fields of percentiles of histograms and timers.
+var dropwizardQuantiles = map[string]float64{
+	"p50":  0.5,
+	"p75":  0.75,
+	"p95":  0.95,
+	"p98":  0.98,
+	"p99":  0.99,
+	"p999": 0.999,
+}
+
+// dropwizardDurations are the duration_units of timers per second, to divide
+// their values by.
+var dropwizardDurations = map[string]float64{
+	"":             1,
+	"seconds":      1,
+	"milliseconds": 1e3,
+	"microseconds": 1e6,
+	"nanoseconds":  1e9,
+	"minutes":      1.0 / 60,
+	"hours":        1.0 / 3600,
+	"days":         1.0 / 86400,
+}
+
+// collectDropwizard flattens the sections of the metrics of Dropwizard,
+// like the Prometheus client of Dropwizard does:
+//
+//   - gauges by their value; those with other values than numbers and
+//     booleans are flattened like expvars,
+//   - counters as gauges, since they can decrease,
+//   - meters as counters with _total, ignoring their rates,
+//   - histograms and timers as summaries of their percentiles, with timers
+//     in seconds.
+//
+// Dropwizard does not report the sums of histograms and timers, so they are
+// estimated as mean times count.
+func (c *collector) collectDropwizard(dec *json.Decoder) error {
+	var m dropwizardMetrics
+	if err := dec.Decode(&m); err != nil {
+		return err
+	}
+
+	for _, name := range sortedKeys(m.Gauges) {
+		v := m.Gauges[name]["value"]
+		switch v.(type) {
+		case json.Number, bool:
+			c.add(Sample{Name: name, Value: valToFloat(v), Meta: &MetricConfig{Type: "gauge"}})
+		default:
+			c.collectMetrics([]string{"gauges", name}, name, nil, v)
+		}
+	}
+	for _, name := range sortedKeys(m.Counters) {
+		if count, ok := m.Counters[name]["count"].(json.Number); ok {
+			c.add(Sample{Name: name, Value: valToFloat(count), Meta: &MetricConfig{Type: "gauge"}})
+		}
+	}
+	for _, name := range sortedKeys(m.Meters) {
+		if count, ok := m.Meters[name]["count"].(json.Number); ok {
+			c.add(Sample{Name: name + "_total", Value: valToFloat(count), Meta: &MetricConfig{Type: "counter"}})
+		}
+	}
+	for _, name := range sortedKeys(m.Histograms) {
+		c.addDropwizardSummary(name, m.Histograms[name], 1)
+	}
+	for _, name := range sortedKeys(m.Timers) {
+		fields := m.Timers[name]
+		unit, _ := fields["duration_units"].(string)
+		perSecond, ok := dropwizardDurations[unit]
+		if !ok {
+			c.fail(fmt.Errorf("timer %q: unknown duration_units %q", name, unit))
+			return nil
+		}
+		c.addDropwizardSummary(name, fields, perSecond)
+	}
+	return nil
+}
+
+// addDropwizardSummary adds the histogram or timer as summary, dividing its
+// values by div.
+func (c *collector) addDropwizardSummary(name string, fields map[string]interface{}, div float64) {
+	count, ok := fields["count"].(json.Number)
+	if !ok {
+		return
+	}
+	sm := &Summary{Quantiles: make(map[float64]float64, len(dropwizardQuantiles))}
+	sm.Count = uint64(valToFloat(count))
+	if mean, ok := fields["mean"].(json.Number); ok {
+		sm.Sum = valToFloat(mean) / div * float64(sm.Count)
+	}
+	for field, q := range dropwizardQuantiles {
+		if v, ok := fields[field].(json.Number); ok {
+			sm.Quantiles[q] = valToFloat(v) / div
+		}
+	}
+	c.add(Sample{Name: name, Summary: sm, Meta: &MetricConfig{Type: "summary"}})
+}
+
+func sortedKeys[V any](m map[string]V) []string {
+	keys := make([]string, 0, len(m))
+	for k := range m {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	return keys
+}
@@ -0,0 +1,70 @@
+package expvarcollector
+
+import (
+	"encoding/json"
+	"unicode/utf8"
+)
+
+// maxExemplarRunes is the OpenMetrics limit of the combined length of names
+// and values of exemplar labels.
+const maxExemplarRunes = 128
+
+// parseExemplar returns the exemplar labels and value of the map m as
+// configured by the path. The labels are nil if a field is missing or they are too long,
+// and the value is 0 without ExemplarValue.
+func parseExemplar(pc *PathConfig, m map[string]interface{}) ([]Label, float64) {
+	labels := exemplarLabels(pc.Exemplar, m)
+	if labels == nil || pc.ExemplarValue == "" {
+		return labels, 0
+	}
+	switch v := m[pc.ExemplarValue].(type) {
+	case json.Number:
+		if f, err := v.Float64(); err == nil {
+			return labels, f
+		}
+	case float64:
+		return labels, v
+	}
+	return nil, 0
+}
+
+// exemplarLabels returns the exemplar labels of the map m as configured by
+// fields, or nil if a field is missing or the labels are too long.
+func exemplarLabels(fields map[string]string, m map[string]interface{}) []Label {
+	if len(fields) == 0 {
+		return nil
+	}
+	labels := make([]Label, 0, len(fields))
+	length := 0
+	for name, field := range fields {
+		var value string
+		switch v := m[field].(type) {
+		case string:
+			value = v
+		case json.Number:
+			value = v.String()
+		default:
+			return nil
+		}
+		if value == "" {
+			return nil
+		}
+		length += utf8.RuneCountInString(name) + utf8.RuneCountInString(value)
+		labels = append(labels, Label{Name: name, Value: value})
+	}
+	if length > maxExemplarRunes {
+		return nil
+	}
+	SortLabels(labels)
+	return labels
+}
+
+// isExemplarField reports whether the key is a source of exemplar labels.
+func isExemplarField(fields map[string]string, key string) bool {
+	for _, field := range fields {
+		if field == key {
+			return true
+		}
+	}
+	return false
+}
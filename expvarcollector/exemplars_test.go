@@ -0,0 +1,64 @@
+package expvarcollector
+
+import (
+	"testing"
+)
+
+func TestExemplars(t *testing.T) {
+	body := `{"rpc": {"TraceID": "4bf92f3577b34da6", "LastLatencySeconds": 0.25, "Calls": 1234}}`
+	tests := []struct {
+		name      string
+		path      PathConfig
+		wantTrace string
+		wantValue float64
+	}{
+		{
+			name:      "value field",
+			path:      PathConfig{Path: "rpc", Exemplar: map[string]string{"trace_id": "TraceID"}, ExemplarValue: "LastLatencySeconds"},
+			wantTrace: "4bf92f3577b34da6",
+			wantValue: 0.25,
+		},
+		{
+			name:      "no value field",
+			path:      PathConfig{Path: "rpc", Exemplar: map[string]string{"trace_id": "TraceID"}},
+			wantTrace: "4bf92f3577b34da6",
+		},
+		{
+			name: "missing value field",
+			path: PathConfig{Path: "rpc", Exemplar: map[string]string{"trace_id": "TraceID"}, ExemplarValue: "Missing"},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			rules := &Rules{Paths: []*PathConfig{&tt.path}}
+			if err := rules.Compile(); err != nil {
+				t.Fatal(err)
+			}
+			samples := decodeString(t, body, &Options{Rules: rules})
+			var calls *Sample
+			for i := range samples {
+				switch samples[i].Name {
+				case "rpc_Calls":
+					calls = &samples[i]
+				case "rpc_TraceID", "rpc_" + tt.path.ExemplarValue:
+					t.Errorf("exemplar field exported as %s", samples[i].Name)
+				}
+			}
+			if calls == nil {
+				t.Fatalf("rpc_Calls missing in %v", samples)
+			}
+			if calls.Value != 1234 {
+				t.Errorf("got value %v, want 1234", calls.Value)
+			}
+			trace := ""
+			if len(calls.Exemplar) == 1 && calls.Exemplar[0].Name == "trace_id" {
+				trace = calls.Exemplar[0].Value
+			} else if calls.Exemplar != nil {
+				t.Fatalf("got exemplar %v", calls.Exemplar)
+			}
+			if trace != tt.wantTrace || calls.ExemplarValue != tt.wantValue {
+				t.Errorf("got exemplar %q with value %v, want %q with value %v", trace, calls.ExemplarValue, tt.wantTrace, tt.wantValue)
+			}
+		})
+	}
+}
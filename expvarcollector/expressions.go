@@ -0,0 +1,120 @@
+package expvarcollector
+
+import (
+	"encoding/json"
+	"fmt"
+	"log/slog"
+	"strconv"
+	"sync"
+
+	"github.com/google/cel-go/cel"
+	"github.com/google/cel-go/common/types"
+)
+
+// exprEnv declares the variables of the CEL expressions of paths: value, the
+// number being flattened, parent, the map holding it, and name, its
+// unsanitized metric name.
+var exprEnv = sync.OnceValues(func() (*cel.Env, error) {
+	return cel.NewEnv(
+		cel.Variable("value", cel.DynType),
+		cel.Variable("parent", cel.MapType(cel.StringType, cel.DynType)),
+		cel.Variable("name", cel.StringType),
+	)
+})
+
+// compileExpr compiles the CEL expression of a path, which must evaluate to
+// a number or bool.
+func compileExpr(expr string) (cel.Program, error) {
+	env, err := exprEnv()
+	if err != nil {
+		return nil, err
+	}
+	ast, iss := env.Compile(expr)
+	if iss.Err() != nil {
+		return nil, iss.Err()
+	}
+	switch ast.OutputType() {
+	case cel.DoubleType, cel.IntType, cel.UintType, cel.BoolType, cel.DynType:
+	default:
+		return nil, fmt.Errorf("expression returns %s instead of a number", ast.OutputType())
+	}
+	return env.Program(ast)
+}
+
+// addValue records a number at path, transformed by the expression of its
+// path config if any. Values failing the expression are dropped.
+func (c *collector) addValue(path []string, name string, labels []Label, v float64) {
+	if c.Rules.hasExprs() {
+		pc := c.Rules.Path(path)
+		if pc != nil && pc.program != nil {
+			var ok bool
+			if v, ok = c.evalExpr(pc, name, v); !ok {
+				return
+			}
+		}
+	}
+	c.addSample(name, labels, v)
+}
+
+// evalExpr evaluates the expression of pc for the value v in c.parent.
+func (c *collector) evalExpr(pc *PathConfig, name string, v float64) (float64, bool) {
+	if c.parentVars == nil {
+		c.parentVars = exprValue(c.parent).(map[string]interface{})
+	}
+	out, _, err := pc.program.Eval(map[string]interface{}{
+		"value":  v,
+		"parent": c.parentVars,
+		"name":   name,
+	})
+	if err != nil {
+		slog.Warn("failed to evaluate expression", "target", c.target, "name", name, "expr", pc.Expr, "err", err)
+		return 0, false
+	}
+	switch out := out.(type) {
+	case types.Double:
+		return float64(out), true
+	case types.Int:
+		return float64(out), true
+	case types.Uint:
+		return float64(out), true
+	case types.Bool:
+		return valToFloat(bool(out)), true
+	}
+	slog.Warn("expression returned no number", "target", c.target, "name", name, "expr", pc.Expr, "value", out.Value())
+	return 0, false
+}
+
+// withParent flattens the children of the map m by calling collect with m
+// as parent of expressions.
+func (c *collector) withParent(m map[string]interface{}, collect func()) {
+	if !c.Rules.hasExprs() {
+		collect()
+		return
+	}
+	parent, vars := c.parent, c.parentVars
+	c.parent, c.parentVars = m, nil
+	collect()
+	c.parent, c.parentVars = parent, vars
+}
+
+// exprValue converts decoded JSON into CEL values, with numbers as doubles.
+func exprValue(v interface{}) interface{} {
+	switch v := v.(type) {
+	case json.Number:
+		f, _ := strconv.ParseFloat(string(v), 64)
+		return f
+	case map[string]interface{}:
+		m := make(map[string]interface{}, len(v))
+		for k, e := range v {
+			m[k] = exprValue(e)
+		}
+		return m
+	case []interface{}:
+		l := make([]interface{}, len(v))
+		for i, e := range v {
+			l[i] = exprValue(e)
+		}
+		return l
+	}
+	return v
+}
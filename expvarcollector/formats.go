@@ -0,0 +1,60 @@
+package expvarcollector
+
+import (
+	"bufio"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/url"
+)
+
+// Formats of target responses, which select the parser of Options.Format.
+const (
+	FormatExpvar         = "expvar"          // expvar JSON, flattened by rules
+	FormatSpringActuator = "spring-actuator" // /actuator/metrics/{name} of Spring Boot
+	FormatDropwizard     = "dropwizard"      // metrics servlet of Dropwizard
+	FormatJolokia        = "jolokia"         // read requests of Jolokia
+	FormatKeyValue       = "keyvalue"        // key:value lines like Redis INFO
+	FormatPrometheus     = "prometheus"      // Prometheus metrics, passed through
+)
+
+// CheckFormat validates a format. The empty format is FormatExpvar.
+func CheckFormat(format string) error {
+	switch format {
+	case "", FormatExpvar, FormatSpringActuator, FormatDropwizard, FormatJolokia, FormatKeyValue, FormatPrometheus:
+		return nil
+	}
+	return fmt.Errorf("unknown format %q", format)
+}
+
+// collectFormat flattens the response read from r, with header h, according
+// to the format of the options.
+func (c *collector) collectFormat(r *bufio.Reader, h http.Header, target *url.URL) error {
+	switch c.Format {
+	case FormatKeyValue:
+		return c.collectKeyValue(r)
+	case FormatPrometheus:
+		return c.collectPrometheus(r, h)
+	}
+
+	// Replace "\xNN" with "?" because the default parser doesn't handle them
+	// well.
+	dec := json.NewDecoder(&hexEscapeReplacer{r: r})
+
+	// Numbers are decoded as json.Number, so that integers used as labels,
+	// like IDs, keep all their digits instead of being rounded to float64.
+	dec.UseNumber()
+
+	switch {
+	case c.Format == FormatSpringActuator:
+		return c.collectSpringActuator(dec, target)
+	case c.Format == FormatDropwizard:
+		return c.collectDropwizard(dec)
+	case c.Format == FormatJolokia:
+		return c.collectJolokia(dec)
+	case c.Script != nil:
+		return c.collectScript(dec, c.Script)
+	default:
+		return c.collectStream(dec)
+	}
+}
@@ -0,0 +1,166 @@
+package expvarcollector
+
+import (
+	"math"
+	"sort"
+	"sync"
+	"time"
+)
+
+// gcPauseBuckets are the upper bounds of go_gc_pause_seconds, in seconds.
+var gcPauseBuckets = []float64{
+	0.00001, 0.000025, 0.00005, 0.0001, 0.00025, 0.0005,
+	0.001, 0.0025, 0.005, 0.01, 0.025, 0.05, 0.1, 0.25, 0.5, 1,
+}
+
+// Native histograms use exponential buckets of the schema, whose upper bounds
+// grow by the factor 2^(2^-NativeSchema), and a zero bucket for observations
+// up to NativeZeroThreshold, like the default of client_golang.
+const (
+	NativeSchema        = 3
+	NativeZeroThreshold = 2.938735877055719e-39 // 2^-128
+)
+
+// nativeBounds are the upper bounds of buckets in [0.5, 1) for NativeSchema,
+// as multiples of fractions returned by math.Frexp.
+var nativeBounds = func() []float64 {
+	bounds := make([]float64, 1<<NativeSchema)
+	for i := range bounds {
+		bounds[i] = math.Exp2(float64(i)/float64(len(bounds))) / 2
+	}
+	return bounds
+}()
+
+// Histogram is a synthesized histogram with cumulative bucket counts.
+type Histogram struct {
+	Bounds []float64 // upper bounds, excluding +Inf
+	Counts []uint64  // cumulative counts per bound
+	Count  uint64
+	Sum    float64
+
+	// Native counts observations by index of native bucket, except for those
+	// in the zero bucket. It is nil for histograms without native buckets,
+	// such as those passed through from Prometheus targets or given by
+	// scripts.
+	Native    map[int]uint64
+	ZeroCount uint64
+}
+
+// GCPauseTracker builds go_gc_pause_seconds histograms from the PauseNs ring
+// buffer of memstats.
+//
+// The ring buffer only holds the last 256 pauses, so the histogram of each
+// target is accumulated across scrapes from the pauses that appeared since
+// the previous scrape. Its count is the number of pauses observed by the
+// exporter, which is less than NumGC if pauses were missed between scrapes.
+type GCPauseTracker struct {
+	mu      sync.Mutex
+	targets map[string]*gcPauseHistory
+}
+
+type gcPauseHistory struct {
+	lastScrape time.Time
+	numGC      uint64
+	hist       Histogram
+}
+
+// Observe adds new pauses from the ring buffer and returns a snapshot of the
+// histogram of the target.
+func (t *GCPauseTracker) Observe(target string, numGC uint64, pauseNs []float64) Histogram {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	now := time.Now()
+	if t.targets == nil {
+		t.targets = make(map[string]*gcPauseHistory)
+	}
+	for key, h := range t.targets {
+		if now.Sub(h.lastScrape) > TargetStateTTL {
+			delete(t.targets, key)
+		}
+	}
+
+	h := t.targets[target]
+	if h == nil || numGC < h.numGC {
+		// New target or restarted process.
+		h = &gcPauseHistory{hist: Histogram{
+			Bounds: gcPauseBuckets,
+			Counts: make([]uint64, len(gcPauseBuckets)),
+			Native: make(map[int]uint64),
+		}}
+		t.targets[target] = h
+	}
+	h.lastScrape = now
+
+	first := h.numGC + 1
+	if size := uint64(len(pauseNs)); numGC > size && first < numGC-size+1 {
+		first = numGC - size + 1
+	}
+	for gc := first; gc <= numGC && len(pauseNs) > 0; gc++ {
+		// The pause of the n-th GC is at PauseNs[(n+255)%256].
+		h.hist.observe(pauseNs[(gc-1)%uint64(len(pauseNs))] / 1e9)
+	}
+	h.numGC = numGC
+
+	snapshot := h.hist
+	snapshot.Counts = append([]uint64(nil), h.hist.Counts...)
+	snapshot.Native = make(map[int]uint64, len(h.hist.Native))
+	for i, n := range h.hist.Native {
+		snapshot.Native[i] = n
+	}
+	return snapshot
+}
+
+func (h *Histogram) observe(v float64) {
+	for i, bound := range h.Bounds {
+		if v <= bound {
+			h.Counts[i]++
+		}
+	}
+	if v <= NativeZeroThreshold {
+		h.ZeroCount++
+	} else {
+		h.Native[nativeIndex(v)]++
+	}
+	h.Count++
+	h.Sum += v
+}
+
+// nativeIndex returns the index of the native bucket of a positive value,
+// whose upper bound is 2^(index/2^NativeSchema).
+func nativeIndex(v float64) int {
+	frac, exp := math.Frexp(v)
+	return sort.SearchFloat64s(nativeBounds, frac) + (exp-1)*len(nativeBounds)
+}
+
+// NativeBuckets returns the native buckets in the sparse protobuf encoding:
+// spans of consecutive indexes and the deltas between their counts.
+func (h *Histogram) NativeBuckets() (spans []NativeSpan, deltas []int64) {
+	indexes := make([]int, 0, len(h.Native))
+	for i := range h.Native {
+		indexes = append(indexes, i)
+	}
+	sort.Ints(indexes)
+
+	var last int
+	var lastCount uint64
+	for n, i := range indexes {
+		switch {
+		case n == 0:
+			spans = append(spans, NativeSpan{Offset: i})
+		case i > last+1:
+			spans = append(spans, NativeSpan{Offset: i - last - 1})
+		}
+		spans[len(spans)-1].Length++
+		deltas = append(deltas, int64(h.Native[i])-int64(lastCount))
+		last, lastCount = i, h.Native[i]
+	}
+	return spans, deltas
+}
+
+// NativeSpan is a run of consecutive native buckets, starting at Offset from
+// the end of the previous span.
+type NativeSpan struct {
+	Offset int
+	Length int
+}
@@ -0,0 +1,85 @@
+package expvarcollector
+
+import (
+	"math"
+	"testing"
+
+	"github.com/prometheus/client_golang/prometheus"
+	dto "github.com/prometheus/client_model/go"
+)
+
+func TestNativeIndex(t *testing.T) {
+	above := func(v float64) float64 { return math.Nextafter(v, math.Inf(1)) }
+	tests := []struct {
+		v    float64
+		want int
+	}{
+		{1, 0},
+		{above(1), 1},
+		{2, 8},
+		{above(2), 9},
+		{4, 16},
+		{above(4), 17},
+		{0.5, -8},
+		{above(0.5), -7},
+		{0.25, -16},
+		{1024, 80},
+		{above(1024), 81},
+		{math.Exp2(1.0 / 8), 1},
+		{above(math.Exp2(1.0 / 8)), 2},
+		{1.5, 5}, // 2^(4/8) < 1.5 <= 2^(5/8)
+		{3e-9, -226},
+	}
+	for _, tt := range tests {
+		if got := nativeIndex(tt.v); got != tt.want {
+			t.Errorf("nativeIndex(%v) = %d, want %d", tt.v, got, tt.want)
+		}
+	}
+}
+
+// TestNativeIndexClientGolang compares the indexes with those of a native
+// histogram of client_golang with the same schema.
+func TestNativeIndexClientGolang(t *testing.T) {
+	values := []float64{1, 2, 4, 0.5, 1.5, 3, 1e-6, 3e-9, 0.001, 0.0125, 1234.5, math.Exp2(3.0 / 8)}
+	for _, v := range values {
+		for _, v := range []float64{v, math.Nextafter(v, 0), math.Nextafter(v, math.Inf(1))} {
+			h := prometheus.NewHistogram(prometheus.HistogramOpts{
+				Name:                         "test",
+				NativeHistogramBucketFactor:  math.Exp2(math.Exp2(-NativeSchema)),
+				NativeHistogramZeroThreshold: NativeZeroThreshold,
+			})
+			h.Observe(v)
+			var m dto.Metric
+			if err := h.Write(&m); err != nil {
+				t.Fatal(err)
+			}
+			if schema := m.GetHistogram().GetSchema(); schema != NativeSchema {
+				t.Fatalf("client_golang used schema %d, want %d", schema, NativeSchema)
+			}
+			want := int(m.GetHistogram().GetPositiveSpan()[0].GetOffset())
+			if got := nativeIndex(v); got != want {
+				t.Errorf("nativeIndex(%v) = %d, client_golang has %d", v, got, want)
+			}
+		}
+	}
+}
+
+func TestNativeBuckets(t *testing.T) {
+	h := &Histogram{Native: map[int]uint64{-2: 1, -1: 3, 4: 2, 5: 2}}
+	spans, deltas := h.NativeBuckets()
+	wantSpans := []NativeSpan{{Offset: -2, Length: 2}, {Offset: 4, Length: 2}}
+	wantDeltas := []int64{1, 2, -1, 0}
+	if len(spans) != len(wantSpans) {
+		t.Fatalf("got spans %v, want %v", spans, wantSpans)
+	}
+	for i := range spans {
+		if spans[i] != wantSpans[i] {
+			t.Errorf("got spans %v, want %v", spans, wantSpans)
+		}
+	}
+	for i := range wantDeltas {
+		if i >= len(deltas) || deltas[i] != wantDeltas[i] {
+			t.Fatalf("got deltas %v, want %v", deltas, wantDeltas)
+		}
+	}
+}
@@ -0,0 +1,206 @@
+package expvarcollector
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"strings"
+)
+
+// jolokiaResponse is the response of Jolokia to a read request.
+type jolokiaResponse struct {
+	Request struct {
+		MBean     string      `json:"mbean"`
+		Attribute interface{} `json:"attribute"` // a name, a list of names or none
+		Path      string      `json:"path"`
+	} `json:"request"`
+	Value  interface{} `json:"value"`
+	Status int         `json:"status"`
+	Error  string      `json:"error"`
+}
+
+// JolokiaReadRequest returns the body of a bulk request to read all
+// attributes of the MBeans, which may be patterns like
+// "java.lang:type=GarbageCollector,name=*", to be POSTed to a Jolokia agent.
+func JolokiaReadRequest(mbeans []string) ([]byte, error) {
+	type read struct {
+		Type  string `json:"type"`
+		MBean string `json:"mbean"`
+	}
+	reads := make([]read, len(mbeans))
+	for i, mbean := range mbeans {
+		if _, _, err := parseObjectName(mbean); err != nil {
+			return nil, err
+		}
+		reads[i] = read{Type: "read", MBean: mbean}
+	}
+	return json.Marshal(reads)
+}
+
+// collectJolokia flattens the responses of Jolokia to a read request, e.g.
+// to GET /jolokia/read/java.lang:type=Memory, or a bulk request from
+// JolokiaReadRequest. Metrics are named like the default ones of the JMX
+// exporter: the domain, the type and the attribute of MBeans, followed by
+// the keys of composite values, with the other key properties of MBeans as
+// labels, so
+//
+//	{"request": {"mbean": "java.lang:name=G1 Young Generation,type=GarbageCollector", "type": "read"},
+//	 "value": {"CollectionCount": 12}, "status": 200}
+//
+// becomes java_lang_GarbageCollector_CollectionCount{name="G1 Young Generation"} 12.
+// Failed reads fail the scrape, or are logged and skipped in bulk requests.
+func (c *collector) collectJolokia(dec *json.Decoder) error {
+	var raw json.RawMessage
+	if err := dec.Decode(&raw); err != nil {
+		return err
+	}
+	bulk := bytes.HasPrefix(bytes.TrimSpace(raw), []byte("["))
+	var responses []jolokiaResponse
+	rdec := json.NewDecoder(bytes.NewReader(raw))
+	rdec.UseNumber()
+	if bulk {
+		if err := rdec.Decode(&responses); err != nil {
+			return err
+		}
+	} else {
+		responses = make([]jolokiaResponse, 1)
+		if err := rdec.Decode(&responses[0]); err != nil {
+			return err
+		}
+	}
+
+	for _, r := range responses {
+		if r.Status != http.StatusOK {
+			err := fmt.Errorf("error reading MBean %q: status %d: %s", r.Request.MBean, r.Status, r.Error)
+			if !bulk {
+				c.fail(err)
+				return nil
+			}
+			slog.Warn("failed to read MBean", "target", c.target, "mbean", r.Request.MBean, "status", r.Status, "err", r.Error)
+			continue
+		}
+		if !strings.ContainsAny(r.Request.MBean, "*?") {
+			c.collectMBean(r.Request.MBean, r.Request.Attribute, r.Request.Path, r.Value)
+			continue
+		}
+		// Patterns are answered with the attributes of each matching MBean.
+		mbeans, _ := r.Value.(map[string]interface{})
+		for mbean, attrs := range mbeans {
+			c.collectMBean(mbean, nil, r.Request.Path, attrs)
+		}
+	}
+	return nil
+}
+
+// collectMBean flattens the value read from the attribute of the MBean, or
+// its attributes by name if attribute isn't a single name.
+func (c *collector) collectMBean(mbean string, attribute interface{}, path string, v interface{}) {
+	domain, props, err := parseObjectName(mbean)
+	if err != nil {
+		slog.Warn("invalid MBean name", "target", c.target, "mbean", mbean, "err", err)
+		return
+	}
+	name := domain
+	var labels []Label
+	for _, p := range props {
+		if p.Name == "type" {
+			name += "_" + p.Value
+			continue
+		}
+		labels = append(labels, Label{Name: jolokiaLabelName(p.Name), Value: p.Value})
+	}
+	SortLabels(labels)
+
+	suffix := ""
+	if path != "" {
+		suffix = "_" + strings.ReplaceAll(path, "/", "_")
+	}
+	if attr, ok := attribute.(string); ok {
+		c.collectMetrics([]string{mbean, attr}, name+"_"+attr+suffix, labels, v)
+		return
+	}
+	attrs, ok := v.(map[string]interface{})
+	if !ok {
+		return
+	}
+	for attr, av := range attrs {
+		c.collectMetrics([]string{mbean, attr}, name+"_"+attr+suffix, labels, av)
+	}
+}
+
+// parseObjectName splits a JMX object name like
+// `java.lang:type=MemoryPool,name="G1 Eden Space"` into its domain and key
+// properties in their order in the name, unquoting quoted values. The
+// wildcard "*" of property list patterns like `java.lang:type=MemoryPool,*`
+// is skipped.
+func parseObjectName(mbean string) (string, []Label, error) {
+	domain, rest, ok := strings.Cut(mbean, ":")
+	if !ok || domain == "" || rest == "" {
+		return "", nil, fmt.Errorf("invalid MBean name %q", mbean)
+	}
+	var props []Label
+	seen := make(map[string]bool)
+	for rest != "" {
+		if prop, next, _ := strings.Cut(rest, ","); prop == "*" {
+			rest = next
+			continue
+		}
+		key, value, ok := strings.Cut(rest, "=")
+		if !ok || key == "" || strings.ContainsAny(key, ",\"") {
+			return "", nil, fmt.Errorf("invalid key property in MBean name %q", mbean)
+		}
+		if seen[key] {
+			return "", nil, fmt.Errorf("duplicate key %q in MBean name %q", key, mbean)
+		}
+		seen[key] = true
+		rest = ""
+		if strings.HasPrefix(value, `"`) {
+			end := quoteEnd(value)
+			if end < 0 {
+				return "", nil, fmt.Errorf("unterminated quote in MBean name %q", mbean)
+			}
+			if next := value[end+1:]; next != "" {
+				if next[0] != ',' {
+					return "", nil, fmt.Errorf("invalid quoted value in MBean name %q", mbean)
+				}
+				rest = next[1:]
+			}
+			value = strings.NewReplacer(`\"`, `"`, `\\`, `\`, `\n`, "\n", `\*`, "*", `\?`, "?").Replace(value[1:end])
+		} else if i := strings.IndexByte(value, ','); i >= 0 {
+			value, rest = value[:i], value[i+1:]
+		}
+		props = append(props, Label{Name: key, Value: value})
+	}
+	return domain, props, nil
+}
+
+// quoteEnd returns the index of the closing quote of the quoted value s, or
+// -1.
+func quoteEnd(s string) int {
+	for i := 1; i < len(s); i++ {
+		switch s[i] {
+		case '\\':
+			i++
+		case '"':
+			return i
+		}
+	}
+	return -1
+}
+
+// jolokiaLabelName turns a key property of an MBean into a label name by
+// replacing invalid characters with underscores.
+func jolokiaLabelName(key string) string {
+	name := strings.Map(func(r rune) rune {
+		if r >= 'a' && r <= 'z' || r >= 'A' && r <= 'Z' || r >= '0' && r <= '9' || r == '_' {
+			return r
+		}
+		return '_'
+	}, key)
+	if name[0] >= '0' && name[0] <= '9' {
+		name = "_" + name
+	}
+	return name
+}
@@ -0,0 +1,79 @@
+package expvarcollector
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestParseObjectName(t *testing.T) {
+	tests := []struct {
+		mbean   string
+		domain  string
+		props   []Label
+		invalid bool
+	}{
+		{mbean: "java.lang:type=Memory", domain: "java.lang", props: []Label{{"type", "Memory"}}},
+		{
+			mbean:  "java.lang:type=GarbageCollector,name=G1 Young Generation",
+			domain: "java.lang",
+			props:  []Label{{"type", "GarbageCollector"}, {"name", "G1 Young Generation"}},
+		},
+		{
+			mbean:  "java.lang:name=G1 Young Generation,type=GarbageCollector",
+			domain: "java.lang",
+			props:  []Label{{"name", "G1 Young Generation"}, {"type", "GarbageCollector"}},
+		},
+		{
+			mbean:  `app:name="a,b",type=Cache`,
+			domain: "app",
+			props:  []Label{{"name", "a,b"}, {"type", "Cache"}},
+		},
+		{
+			mbean:  `app:type=Cache,name="a=b,c"`,
+			domain: "app",
+			props:  []Label{{"type", "Cache"}, {"name", "a=b,c"}},
+		},
+		{
+			mbean:  `app:name="say \"hi\"\\",type=Cache`,
+			domain: "app",
+			props:  []Label{{"name", `say "hi"\`}, {"type", "Cache"}},
+		},
+		{
+			mbean:  `app:name="\*\?\n"`,
+			domain: "app",
+			props:  []Label{{"name", "*?\n"}},
+		},
+		{
+			mbean:  "java.lang:type=MemoryPool,*",
+			domain: "java.lang",
+			props:  []Label{{"type", "MemoryPool"}},
+		},
+		{mbean: "java.lang:type=GarbageCollector,name=*", domain: "java.lang", props: []Label{{"type", "GarbageCollector"}, {"name", "*"}}},
+		{mbean: "java.lang", invalid: true},
+		{mbean: ":type=Memory", invalid: true},
+		{mbean: "java.lang:", invalid: true},
+		{mbean: "java.lang:type", invalid: true},
+		{mbean: "java.lang:=Memory", invalid: true},
+		{mbean: "java.lang:a,type=Memory", invalid: true},
+		{mbean: "java.lang:type=Memory,type=Runtime", invalid: true},
+		{mbean: `app:name="a,type=Cache`, invalid: true},
+		{mbean: `app:name="a"b,type=Cache`, invalid: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.mbean, func(t *testing.T) {
+			domain, props, err := parseObjectName(tt.mbean)
+			if tt.invalid {
+				if err == nil {
+					t.Fatalf("got %q %v, want an error", domain, props)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			if domain != tt.domain || !reflect.DeepEqual(props, tt.props) {
+				t.Errorf("got %q %v, want %q %v", domain, props, tt.domain, tt.props)
+			}
+		})
+	}
+}
@@ -0,0 +1,188 @@
+package expvarcollector
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+)
+
+// ExtractConfig exports the values selected by a JSONPath as a metric, in
+// addition to the usual flattening of the expvars.
+type ExtractConfig struct {
+	// Path is a JSONPath of the values, e.g.
+	// "$.logs-agent.HttpDestinationStats.*.idleMs". It supports child keys
+	// as .key or ['key'], array indexes as [0], and wildcards as .* or [*].
+	Path string `yaml:"path"`
+
+	// Name is the name of the metric. Maps and arrays selected by Path are
+	// flattened into metrics prefixed with it.
+	Name string `yaml:"name"`
+
+	// Labels name the labels taking the keys or indexes matched by the
+	// wildcards of Path, in order, e.g. [destination].
+	Labels []string `yaml:"labels"`
+
+	segments []pathSegment
+}
+
+// pathSegment is a step of a JSONPath: a child key, an array index, or a
+// wildcard matching all children.
+type pathSegment struct {
+	key      string
+	index    int // -1 unless an array index
+	wildcard bool
+}
+
+// parseJSONPath parses the subset of JSONPath described at
+// ExtractConfig.Path.
+func parseJSONPath(p string) ([]pathSegment, error) {
+	if !strings.HasPrefix(p, "$") {
+		return nil, fmt.Errorf("JSONPath must start with $")
+	}
+	rest := p[1:]
+	var segments []pathSegment
+	for rest != "" {
+		switch {
+		case strings.HasPrefix(rest, ".."):
+			return nil, fmt.Errorf("recursive descent is not supported")
+		case rest[0] == '.':
+			end := strings.IndexAny(rest[1:], ".[")
+			if end < 0 {
+				end = len(rest) - 1
+			}
+			key := rest[1 : end+1]
+			rest = rest[end+1:]
+			switch key {
+			case "":
+				return nil, fmt.Errorf("empty key")
+			case "*":
+				segments = append(segments, pathSegment{index: -1, wildcard: true})
+			default:
+				segments = append(segments, pathSegment{key: key, index: -1})
+			}
+		case rest[0] == '[':
+			end := strings.IndexByte(rest, ']')
+			if end < 0 {
+				return nil, fmt.Errorf("unterminated [")
+			}
+			sel := rest[1:end]
+			rest = rest[end+1:]
+			switch {
+			case sel == "*":
+				segments = append(segments, pathSegment{index: -1, wildcard: true})
+			case len(sel) >= 2 && (sel[0] == '\'' || sel[0] == '"') && sel[len(sel)-1] == sel[0]:
+				segments = append(segments, pathSegment{key: sel[1 : len(sel)-1], index: -1})
+			default:
+				i, err := strconv.Atoi(sel)
+				if err != nil || i < 0 {
+					return nil, fmt.Errorf("invalid selector [%s]", sel)
+				}
+				segments = append(segments, pathSegment{index: i})
+			}
+		default:
+			return nil, fmt.Errorf("unexpected %q", rest)
+		}
+	}
+	if len(segments) == 0 {
+		return nil, fmt.Errorf("JSONPath selects the root")
+	}
+	if segments[0].index >= 0 {
+		return nil, fmt.Errorf("expvars are an object, not an array")
+	}
+	return segments, nil
+}
+
+// selects reports whether the JSONPath can select values in the top-level
+// expvar key.
+func (ec *ExtractConfig) selects(key string) bool {
+	first := ec.segments[0]
+	return first.wildcard || first.key == key
+}
+
+// wildcards returns the number of wildcards of the JSONPath.
+func wildcards(segments []pathSegment) int {
+	n := 0
+	for _, seg := range segments {
+		if seg.wildcard {
+			n++
+		}
+	}
+	return n
+}
+
+// extracts reports whether extract rules select values in the top-level
+// expvar at the path, which then needs to be decoded as a whole.
+func (r *Rules) extracts(keys []string) bool {
+	if r == nil || len(keys) != 1 {
+		return false
+	}
+	for _, ec := range r.Extract {
+		if ec.selects(keys[0]) {
+			return true
+		}
+	}
+	return false
+}
+
+// extract exports the values selected by the extract rules in the top-level
+// expvar v at key.
+func (c *collector) extract(key string, v interface{}) {
+	if c.Rules == nil {
+		return
+	}
+	for _, ec := range c.Rules.Extract {
+		if !ec.selects(key) {
+			continue
+		}
+		c.selectPath(ec, ec.segments[1:], []string{key}, matchedKeys(ec.segments[0], key, nil), v)
+	}
+}
+
+// selectPath follows the remaining segments of the JSONPath of ec from v at
+// path, and flattens the values found under the name of ec. matched holds
+// the keys matched by wildcards so far.
+func (c *collector) selectPath(ec *ExtractConfig, segments []pathSegment, path []string, matched []string, v interface{}) {
+	if len(segments) == 0 {
+		labels := make([]Label, len(matched))
+		for i, value := range matched {
+			labels[i] = Label{Name: ec.Labels[i], Value: value}
+		}
+		SortLabels(labels)
+		c.collectMetrics(path, ec.Name, labels, v)
+		return
+	}
+	seg, rest := segments[0], segments[1:]
+	child := func(key string, v interface{}) {
+		c.selectPath(ec, rest, append(path[:len(path):len(path)], key), matchedKeys(seg, key, matched), v)
+	}
+	switch v := v.(type) {
+	case map[string]interface{}:
+		switch {
+		case seg.wildcard:
+			for key, lv := range v {
+				child(key, lv)
+			}
+		case seg.index < 0:
+			if lv, ok := v[seg.key]; ok {
+				child(seg.key, lv)
+			}
+		}
+	case []interface{}:
+		switch {
+		case seg.wildcard:
+			for i, lv := range v {
+				child(strconv.Itoa(i), lv)
+			}
+		case seg.index >= 0 && seg.index < len(v):
+			child(strconv.Itoa(seg.index), v[seg.index])
+		}
+	}
+}
+
+// matchedKeys appends key to the keys matched by wildcards if seg is one.
+func matchedKeys(seg pathSegment, key string, matched []string) []string {
+	if !seg.wildcard {
+		return matched
+	}
+	return append(matched[:len(matched):len(matched)], key)
+}
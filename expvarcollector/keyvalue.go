@@ -0,0 +1,78 @@
+package expvarcollector
+
+import (
+	"bufio"
+	"encoding/json"
+	"fmt"
+	"strconv"
+	"strings"
+)
+
+// keyValueMaxLine bounds the length of lines of key:value responses.
+const keyValueMaxLine = 1 << 20
+
+// collectKeyValue flattens a plaintext response of key:value lines, like
+// Redis INFO:
+//
+//	# Clients
+//	connected_clients:2
+//	db0:keys=12,expires=0,avg_ttl=0
+//
+// Each key is handled like a top-level expvar: numbers are flattened as
+// such, lists of key=value pairs as maps, e.g. into db0_keys, and other
+// values as strings. Blank lines, lines starting with # and lines without
+// a colon are ignored.
+func (c *collector) collectKeyValue(r *bufio.Reader) error {
+	scanner := bufio.NewScanner(r)
+	scanner.Buffer(nil, keyValueMaxLine)
+	values := make(map[string]interface{})
+	var keys []string
+	for scanner.Scan() {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		k, v, ok := strings.Cut(line, ":")
+		if !ok {
+			continue
+		}
+		k = strings.TrimSpace(k)
+		if k == "" {
+			continue
+		}
+		if _, dup := values[k]; !dup {
+			keys = append(keys, k)
+		}
+		values[k] = keyValue(strings.TrimSpace(v), true)
+	}
+	if err := scanner.Err(); err != nil {
+		return fmt.Errorf("error reading key:value lines: %w", err)
+	}
+
+	for _, k := range keys {
+		c.extract(k, values[k])
+		c.collectMetrics([]string{k}, k, nil, values[k])
+	}
+	return nil
+}
+
+// keyValue converts a value of a key:value line into a number, into a map
+// if pairs is set and it is a comma-separated list of key=value pairs, or
+// else keeps it as string.
+func keyValue(v string, pairs bool) interface{} {
+	if _, err := strconv.ParseFloat(v, 64); err == nil {
+		return json.Number(v)
+	}
+	if !pairs || !strings.Contains(v, "=") {
+		return v
+	}
+	m := make(map[string]interface{})
+	for _, pair := range strings.Split(v, ",") {
+		k, pv, ok := strings.Cut(pair, "=")
+		if !ok || k == "" {
+			return v
+		}
+		m[k] = keyValue(pv, false)
+	}
+	return m
+}
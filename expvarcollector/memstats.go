@@ -0,0 +1,142 @@
+package expvarcollector
+
+import (
+	"encoding/json"
+	"strconv"
+)
+
+// goMetric describes how an expvar is translated into a standard metric of
+// client_golang.
+type goMetric struct {
+	Name  string
+	Help  string
+	Type  string
+	Scale float64 // multiplier of the expvar value, if not 1
+}
+
+// goMemstatsMetrics maps fields of the "memstats" expvar (runtime.MemStats)
+// to the metrics of client_golang's Go collector.
+var goMemstatsMetrics = map[string]goMetric{
+	"Alloc":         {Name: "go_memstats_alloc_bytes", Help: "Number of bytes allocated and still in use.", Type: "gauge"},
+	"TotalAlloc":    {Name: "go_memstats_alloc_bytes_total", Help: "Total number of bytes allocated, even if freed.", Type: "counter"},
+	"Sys":           {Name: "go_memstats_sys_bytes", Help: "Number of bytes obtained from system.", Type: "gauge"},
+	"Lookups":       {Name: "go_memstats_lookups_total", Help: "Total number of pointer lookups.", Type: "counter"},
+	"Mallocs":       {Name: "go_memstats_mallocs_total", Help: "Total number of mallocs.", Type: "counter"},
+	"Frees":         {Name: "go_memstats_frees_total", Help: "Total number of frees.", Type: "counter"},
+	"HeapAlloc":     {Name: "go_memstats_heap_alloc_bytes", Help: "Number of heap bytes allocated and still in use.", Type: "gauge"},
+	"HeapSys":       {Name: "go_memstats_heap_sys_bytes", Help: "Number of heap bytes obtained from system.", Type: "gauge"},
+	"HeapIdle":      {Name: "go_memstats_heap_idle_bytes", Help: "Number of heap bytes waiting to be used.", Type: "gauge"},
+	"HeapInuse":     {Name: "go_memstats_heap_inuse_bytes", Help: "Number of heap bytes that are in use.", Type: "gauge"},
+	"HeapReleased":  {Name: "go_memstats_heap_released_bytes", Help: "Number of heap bytes released to OS.", Type: "gauge"},
+	"HeapObjects":   {Name: "go_memstats_heap_objects", Help: "Number of allocated objects.", Type: "gauge"},
+	"StackInuse":    {Name: "go_memstats_stack_inuse_bytes", Help: "Number of bytes in use by the stack allocator.", Type: "gauge"},
+	"StackSys":      {Name: "go_memstats_stack_sys_bytes", Help: "Number of bytes obtained from system for stack allocator.", Type: "gauge"},
+	"MSpanInuse":    {Name: "go_memstats_mspan_inuse_bytes", Help: "Number of bytes in use by mspan structures.", Type: "gauge"},
+	"MSpanSys":      {Name: "go_memstats_mspan_sys_bytes", Help: "Number of bytes used for mspan structures obtained from system.", Type: "gauge"},
+	"MCacheInuse":   {Name: "go_memstats_mcache_inuse_bytes", Help: "Number of bytes in use by mcache structures.", Type: "gauge"},
+	"MCacheSys":     {Name: "go_memstats_mcache_sys_bytes", Help: "Number of bytes used for mcache structures obtained from system.", Type: "gauge"},
+	"BuckHashSys":   {Name: "go_memstats_buck_hash_sys_bytes", Help: "Number of bytes used by the profiling bucket hash table.", Type: "gauge"},
+	"GCSys":         {Name: "go_memstats_gc_sys_bytes", Help: "Number of bytes used for garbage collection system metadata.", Type: "gauge"},
+	"OtherSys":      {Name: "go_memstats_other_sys_bytes", Help: "Number of bytes used for other system allocations.", Type: "gauge"},
+	"NextGC":        {Name: "go_memstats_next_gc_bytes", Help: "Number of heap bytes when next garbage collection will take place.", Type: "gauge"},
+	"LastGC":        {Name: "go_memstats_last_gc_time_seconds", Help: "Number of seconds since 1970 of last garbage collection.", Type: "gauge", Scale: 1e-9},
+	"GCCPUFraction": {Name: "go_memstats_gc_cpu_fraction", Help: "The fraction of this program's available CPU time used by the GC since the program started.", Type: "gauge"},
+}
+
+// goGCPauseMetric is synthesized from memstats.PauseNs and NumGC.
+var goGCPauseMetric = goMetric{Name: "go_gc_pause_seconds", Help: "Stop-the-world pause durations of garbage collections observed by the exporter.", Type: "histogram"}
+
+// goBySizeMetrics map fields of memstats.BySize entries to metrics labeled by
+// size class.
+var goBySizeMetrics = map[string]goMetric{
+	"Mallocs": {Name: "go_memstats_by_size_mallocs_total", Help: "Total number of mallocs by size class.", Type: "counter"},
+	"Frees":   {Name: "go_memstats_by_size_frees_total", Help: "Total number of frees by size class.", Type: "counter"},
+}
+
+// goMetricsByName indexes metadata of standard metrics by metric name.
+var goMetricsByName = func() map[string]*MetricConfig {
+	m := make(map[string]*MetricConfig, len(goMemstatsMetrics)+len(goBySizeMetrics)+1)
+	for _, gms := range []map[string]goMetric{goMemstatsMetrics, goBySizeMetrics} {
+		for _, gm := range gms {
+			m[gm.Name] = &MetricConfig{Name: gm.Name, Help: gm.Help, Type: gm.Type}
+		}
+	}
+	m[goGCPauseMetric.Name] = &MetricConfig{Name: goGCPauseMetric.Name, Help: goGCPauseMetric.Help, Type: goGCPauseMetric.Type}
+	return m
+}()
+
+// collectMemstats translates known fields of the "memstats" expvar into
+// standard metrics and flattens the rest as usual.
+func (c *collector) collectMemstats(path []string, k string, labels []Label, memstats map[string]interface{}) {
+	if c.GCPauses != nil {
+		c.collectGCPauses(labels, memstats)
+	}
+
+	for field, v := range memstats {
+		gm, known := goMemstatsMetrics[field]
+		n, isNumber := v.(json.Number)
+		if !known || !isNumber {
+			c.collectMetrics(append(path[:len(path):len(path)], field), k+"_"+field, labels, v)
+			continue
+		}
+		f := valToFloat(n)
+		if gm.Scale != 0 {
+			f *= gm.Scale
+		}
+		c.addSample(gm.Name, labels, f)
+	}
+}
+
+// collectGCPauses adds the go_gc_pause_seconds histogram.
+func (c *collector) collectGCPauses(labels []Label, memstats map[string]interface{}) {
+	n, ok := memstats["NumGC"].(json.Number)
+	if !ok {
+		return
+	}
+	numGC, err := strconv.ParseUint(string(n), 10, 64)
+	if err != nil {
+		return
+	}
+	ring, ok := memstats["PauseNs"].([]interface{})
+	if !ok {
+		return
+	}
+	pauseNs := make([]float64, len(ring))
+	for i, v := range ring {
+		n, ok := v.(json.Number)
+		if !ok {
+			return
+		}
+		pauseNs[i] = valToFloat(n)
+	}
+
+	hist := c.GCPauses.Observe(c.target, numGC, pauseNs)
+	c.add(Sample{Name: goGCPauseMetric.Name, Labels: labels, Histogram: &hist})
+}
+
+// collectBySize adds the per size class series of memstats.BySize, an array
+// of {"Size": 8, "Mallocs": 1, "Frees": 0}.
+func (c *collector) collectBySize(labels []Label, bySize []interface{}) {
+	for _, entry := range bySize {
+		class, ok := entry.(map[string]interface{})
+		if !ok {
+			continue
+		}
+		size, ok := class["Size"].(json.Number)
+		if !ok {
+			continue
+		}
+		classLabels := append(labels[:len(labels):len(labels)], Label{Name: "size", Value: size.String()})
+		for field, gm := range goBySizeMetrics {
+			if v, ok := class[field].(json.Number); ok {
+				c.addSample(gm.Name, classLabels, valToFloat(v))
+			}
+		}
+	}
+}
+
+// GoMetric returns the metadata of the standard metric name translated from
+// memstats, or nil.
+func GoMetric(name string) *MetricConfig {
+	return goMetricsByName[name]
+}
@@ -0,0 +1,71 @@
+package expvarcollector
+
+import (
+	"container/list"
+	"sync"
+)
+
+// NameCache is an LRU cache of final metric names by flattened expvar key,
+// so that keys seen in previous scrapes aren't sanitized, filtered and
+// renamed again on every scrape.
+//
+// Names depend on the settings of the Proxy, so a cache must not be shared by
+// proxies with different settings.
+type NameCache struct {
+	Size int
+
+	mu      sync.Mutex
+	entries map[string]*list.Element
+	lru     list.List // of *cachedName, most recently used first
+}
+
+type cachedName struct {
+	key  string
+	name string
+	err  error
+}
+
+// Get returns the cached name of the key, or the result of resolve if the key
+// isn't cached. A nil cache calls resolve every time.
+func (nc *NameCache) Get(key string, resolve func(string) (string, error)) (string, error) {
+	if nc == nil || nc.Size <= 0 {
+		return resolve(key)
+	}
+
+	nc.mu.Lock()
+	if e, ok := nc.entries[key]; ok {
+		nc.lru.MoveToFront(e)
+		cn := e.Value.(*cachedName)
+		nc.mu.Unlock()
+		return cn.name, cn.err
+	}
+	nc.mu.Unlock()
+
+	name, err := resolve(key)
+
+	nc.mu.Lock()
+	defer nc.mu.Unlock()
+	if nc.entries == nil {
+		nc.entries = make(map[string]*list.Element, nc.Size)
+	}
+	if _, ok := nc.entries[key]; !ok {
+		nc.entries[key] = nc.lru.PushFront(&cachedName{key: key, name: name, err: err})
+		if nc.lru.Len() > nc.Size {
+			oldest := nc.lru.Back()
+			nc.lru.Remove(oldest)
+			delete(nc.entries, oldest.Value.(*cachedName).key)
+		}
+	}
+	return name, err
+}
+
+// Reset empties the cache, e.g. after the config changed.
+func (nc *NameCache) Reset() {
+	if nc == nil {
+		return
+	}
+	nc.mu.Lock()
+	defer nc.mu.Unlock()
+	nc.entries = nil
+	nc.lru.Init()
+}
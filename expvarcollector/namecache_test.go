@@ -0,0 +1,55 @@
+package expvarcollector
+
+import (
+	"errors"
+	"strings"
+	"testing"
+)
+
+func TestNameCache(t *testing.T) {
+	errInvalid := errors.New("invalid")
+	upper := func(key string) (string, error) {
+		if key == "bad" {
+			return "", errInvalid
+		}
+		return strings.ToUpper(key), nil
+	}
+	tests := []struct {
+		name     string
+		size     int
+		keys     []string
+		resolved []string // keys resolved, i.e. missed
+	}{
+		{"hits", 2, []string{"a", "b", "a", "b"}, []string{"a", "b"}},
+		{"evicts least recently used", 2, []string{"a", "b", "a", "c", "a", "b"}, []string{"a", "b", "c", "b"}},
+		{"caches errors", 2, []string{"bad", "bad"}, []string{"bad"}},
+		{"disabled", 0, []string{"a", "a"}, []string{"a", "a"}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			nc := &NameCache{Size: tt.size}
+			var resolved []string
+			for _, key := range tt.keys {
+				name, err := nc.Get(key, func(key string) (string, error) {
+					resolved = append(resolved, key)
+					return upper(key)
+				})
+				if want, wantErr := upper(key); name != want || err != wantErr {
+					t.Errorf("Get(%q) = %q, %v, want %q, %v", key, name, err, want, wantErr)
+				}
+			}
+			if strings.Join(resolved, ",") != strings.Join(tt.resolved, ",") {
+				t.Errorf("resolved %q, want %q", resolved, tt.resolved)
+			}
+		})
+	}
+}
+
+func TestNameCacheReset(t *testing.T) {
+	nc := &NameCache{Size: 10}
+	nc.Get("a", func(string) (string, error) { return "old", nil })
+	nc.Reset()
+	if name, _ := nc.Get("a", func(string) (string, error) { return "new", nil }); name != "new" {
+		t.Errorf("got %q after reset, want new", name)
+	}
+}
@@ -0,0 +1,121 @@
+package expvarcollector
+
+import (
+	"errors"
+	"fmt"
+	"strings"
+	"unicode"
+
+	"golang.org/x/text/runes"
+	"golang.org/x/text/transform"
+	"golang.org/x/text/unicode/norm"
+)
+
+// Policies of -names.non-ascii for non-ASCII characters in metric names.
+const (
+	NonASCIIFail          = "fail"          // fail the scrape
+	NonASCIITransliterate = "transliterate" // "é" to "e", others to "_"
+	NonASCIIReplace       = "replace"       // replace with "_"
+	NonASCIIDrop          = "drop"          // drop the metric
+	NonASCIIUTF8          = "utf8"          // keep as UTF-8, escaped as negotiated by scrapers
+)
+
+// CheckNonASCIIPolicy validates a non-ASCII policy.
+func CheckNonASCIIPolicy(policy string) error {
+	switch policy {
+	case NonASCIIFail, NonASCIITransliterate, NonASCIIReplace, NonASCIIDrop, NonASCIIUTF8:
+		return nil
+	}
+	return fmt.Errorf("unknown non-ascii policy %q", policy)
+}
+
+// errDropMetric is returned by sanitizeMetricName for metrics to be dropped.
+var errDropMetric = errors.New("metric dropped")
+
+// stripMarks decomposes characters and removes combining marks, e.g. "é" to
+// "e".
+var stripMarks = transform.Chain(norm.NFKD, runes.Remove(runes.In(unicode.Mn)))
+
+func sanitizeMetricName(n string, nonASCII string) (string, error) {
+	// Prometheus metric names must match the regex
+	// `[a-zA-Z_:][a-zA-Z0-9_:]*`.
+	// https://prometheus.io/docs/concepts/data_model/#metric-names-and-labels
+	//
+	// This function replaces all non-matching ASCII characters with
+	// underscores.
+	//
+	// In particular, it is common that expvar names contain `/` or `-`, which
+	// we replace with `_` so they end up resembling more Prometheus-ideomatic
+	// names.
+	//
+	// Non-ascii characters can't be all reasonably mapped to ascii, so what
+	// to do with them is up to the nonASCII policy. By default the scrape
+	// fails, to force users to handle them explicitly, which is the safest
+	// option and also ensures forwards compatibility. With NonASCIIUTF8 they
+	// are kept and escaped at exposition as negotiated with the scraper.
+	if nonASCII == NonASCIITransliterate && !isASCII(n) {
+		if t, _, err := transform.String(stripMarks, n); err == nil {
+			n = t
+		}
+	}
+
+	var err error
+	name := strings.Map(func(r rune) rune {
+		if r >= 'a' && r <= 'z' {
+			return r
+		}
+		if r >= 'A' && r <= 'Z' {
+			return r
+		}
+		if r >= '0' && r <= '9' {
+			return r
+		}
+		if r == '_' || r == ':' {
+			return r
+		}
+		if r > unicode.MaxASCII && nonASCII == NonASCIIUTF8 {
+			return r
+		}
+		if r > unicode.MaxASCII && err == nil {
+			switch nonASCII {
+			case NonASCIIDrop:
+				err = errDropMetric
+			case NonASCIIReplace, NonASCIITransliterate:
+			default:
+				err = fmt.Errorf(
+					"non-ascii character %q is unsupported, please configure the metric %q explicitly or set -names.non-ascii",
+					r, n)
+			}
+		}
+		return '_'
+	}, n)
+	return name, err
+}
+
+func isASCII(s string) bool {
+	for i := 0; i < len(s); i++ {
+		if s[i] > unicode.MaxASCII {
+			return false
+		}
+	}
+	return true
+}
+
+// toSnakeCase converts CamelCase words into snake_case, e.g. "BytesSent" to
+// "bytes_sent" and "HTTPDestination" to "http_destination".
+func toSnakeCase(s string) string {
+	rs := []rune(s)
+	sb := &strings.Builder{}
+	sb.Grow(len(s) + 4)
+	for i, r := range rs {
+		if unicode.IsUpper(r) && i > 0 {
+			prev := rs[i-1]
+			nextLower := i+1 < len(rs) && unicode.IsLower(rs[i+1])
+			if unicode.IsLower(prev) || unicode.IsDigit(prev) || (unicode.IsUpper(prev) && nextLower) {
+				sb.WriteByte('_')
+			}
+		}
+		sb.WriteRune(unicode.ToLower(r))
+	}
+	return sb.String()
+}
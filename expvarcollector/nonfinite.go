@@ -0,0 +1,42 @@
+package expvarcollector
+
+import (
+	"fmt"
+	"math"
+)
+
+// Policies of -values.non-finite for NaN and infinite values, e.g. parsed from
+// strings like "NaN" and "+Inf" or numbers out of the range of float64.
+const (
+	NonFiniteKeep  = "keep"  // export as NaN, +Inf or -Inf
+	NonFiniteDrop  = "drop"  // drop the sample
+	NonFiniteClamp = "clamp" // infinities to ±math.MaxFloat64, NaN dropped
+)
+
+// CheckNonFinitePolicy validates a policy for non-finite values.
+func CheckNonFinitePolicy(policy string) error {
+	switch policy {
+	case NonFiniteKeep, NonFiniteDrop, NonFiniteClamp:
+		return nil
+	}
+	return fmt.Errorf("unknown policy %q", policy)
+}
+
+// finiteValue applies the policy to v, returning false if the sample is to be
+// dropped.
+func finiteValue(v float64, policy string) (float64, bool) {
+	switch {
+	case policy == NonFiniteKeep || policy == "":
+		return v, true
+	case math.IsNaN(v):
+		return v, false
+	case !math.IsInf(v, 0):
+		return v, true
+	case policy == NonFiniteClamp:
+		if v > 0 {
+			return math.MaxFloat64, true
+		}
+		return -math.MaxFloat64, true
+	}
+	return v, false
+}
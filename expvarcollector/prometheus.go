@@ -0,0 +1,107 @@
+package expvarcollector
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"math"
+	"mime"
+	"net/http"
+
+	dto "github.com/prometheus/client_model/go"
+	"github.com/prometheus/common/expfmt"
+)
+
+// isPrometheus reports whether the Content-Type of a response is a format of
+// Prometheus metrics. Plain text without version isn't, since it is used for
+// other formats and even for JSON.
+func isPrometheus(h http.Header) bool {
+	mediatype, params, err := mime.ParseMediaType(h.Get("Content-Type"))
+	if err != nil {
+		return false
+	}
+	switch mediatype {
+	case "text/plain":
+		return params["version"] != ""
+	case "application/openmetrics-text", expfmt.ProtoType:
+		return true
+	}
+	return false
+}
+
+// collectPrometheus passes through the Prometheus metrics read from r, in
+// the text or protobuf format given by the Content-Type of h, or the text
+// format if unknown. OpenMetrics is parsed as text on a best-effort basis.
+// Metrics keep their help and type, but their names are filtered and renamed
+// like those of expvars.
+func (c *collector) collectPrometheus(r io.Reader, h http.Header) error {
+	format := expfmt.ResponseFormat(h)
+	if format == expfmt.FmtUnknown {
+		format = expfmt.NewFormat(expfmt.TypeTextPlain)
+	}
+	dec := expfmt.NewDecoder(r, format)
+	for {
+		mf := &dto.MetricFamily{}
+		if err := dec.Decode(mf); err != nil {
+			if !errors.Is(err, io.EOF) {
+				c.fail(fmt.Errorf("error parsing Prometheus metrics: %w", err))
+			}
+			return nil
+		}
+		c.addFamily(mf)
+	}
+}
+
+// addFamily adds the samples of a Prometheus metric family.
+func (c *collector) addFamily(mf *dto.MetricFamily) {
+	meta := &MetricConfig{Name: mf.GetName(), Help: mf.GetHelp()}
+	switch mf.GetType() {
+	case dto.MetricType_COUNTER:
+		meta.Type = "counter"
+	case dto.MetricType_GAUGE:
+		meta.Type = "gauge"
+	case dto.MetricType_SUMMARY:
+		meta.Type = "summary"
+	case dto.MetricType_HISTOGRAM, dto.MetricType_GAUGE_HISTOGRAM:
+		meta.Type = "histogram"
+	default:
+		meta.Type = "untyped"
+	}
+
+	for _, m := range mf.GetMetric() {
+		s := Sample{Name: mf.GetName(), Meta: meta, TimestampMs: m.GetTimestampMs()}
+		for _, lp := range m.GetLabel() {
+			s.Labels = append(s.Labels, Label{Name: lp.GetName(), Value: lp.GetValue()})
+		}
+		SortLabels(s.Labels)
+
+		switch {
+		case m.Counter != nil:
+			s.Value = m.Counter.GetValue()
+		case m.Gauge != nil:
+			s.Value = m.Gauge.GetValue()
+		case m.Summary != nil:
+			s.Summary = &Summary{
+				Count:     m.Summary.GetSampleCount(),
+				Sum:       m.Summary.GetSampleSum(),
+				Quantiles: make(map[float64]float64, len(m.Summary.GetQuantile())),
+			}
+			for _, q := range m.Summary.GetQuantile() {
+				s.Summary.Quantiles[q.GetQuantile()] = q.GetValue()
+			}
+		case m.Histogram != nil:
+			h := &Histogram{Count: m.Histogram.GetSampleCount(), Sum: m.Histogram.GetSampleSum()}
+			for _, b := range m.Histogram.GetBucket() {
+				if math.IsInf(b.GetUpperBound(), 1) {
+					continue
+				}
+				h.Bounds = append(h.Bounds, b.GetUpperBound())
+				h.Counts = append(h.Counts, b.GetCumulativeCount())
+			}
+			s.Histogram = h
+		default:
+			s.Value = m.GetUntyped().GetValue()
+		}
+		c.add(s)
+	}
+}
@@ -0,0 +1,362 @@
+package expvarcollector
+
+import (
+	"fmt"
+	"path"
+	"regexp"
+	"strings"
+
+	"github.com/google/cel-go/cel"
+)
+
+// Rules customize how expvars are flattened, named and described. They are
+// usually read from YAML and must be compiled before use. Nil rules leave
+// metrics as they are.
+type Rules struct {
+	Metrics []*MetricConfig `yaml:"metrics"`
+	Paths   []*PathConfig   `yaml:"paths"`
+	Renames []*RenameConfig `yaml:"renames"`
+
+	// Include and Exclude are anchored regular expressions over flattened
+	// names before renaming. If Include is set, only matching metrics are
+	// kept.
+	Include []string `yaml:"include"`
+	Exclude []string `yaml:"exclude"`
+
+	// StripPrefixes are removed from the start of flattened names, e.g.
+	// "stats_" for a redundant top-level key. The first matching prefix is
+	// stripped, unless nothing or an invalid name would remain.
+	StripPrefixes []string `yaml:"strip_prefixes"`
+
+	// Extract exports values selected by JSONPaths as metrics.
+	Extract []*ExtractConfig `yaml:"extract"`
+
+	metricsByName map[string]*MetricConfig
+	exprs         bool
+	includeREs    []*regexp.Regexp
+	excludeREs    []*regexp.Regexp
+}
+
+// MetricConfig declares metadata of an exported metric.
+type MetricConfig struct {
+	// Name is the metric name as exported, e.g. "logs_agent_BytesSent".
+	Name string `yaml:"name"`
+
+	// Help is rendered as "# HELP".
+	Help string `yaml:"help"`
+
+	// Type is rendered as "# TYPE", one of "counter", "gauge" or "untyped".
+	Type string `yaml:"type"`
+}
+
+// PathConfig customizes how the expvar subtree at a path is flattened.
+type PathConfig struct {
+	// Path is a dot-separated list of expvar keys, where each element may be
+	// a glob pattern, e.g. "logs-agent.HttpDestinationStats" or "*.queues".
+	Path string `yaml:"path"`
+
+	// KeyLabel turns the keys of the map at Path into values of this label
+	// instead of appending them to metric names.
+	KeyLabel string `yaml:"key_label"`
+
+	// Parse converts string values at Path, overriding -strings.parse. See
+	// stringParsers for the supported kinds.
+	Parse string `yaml:"parse"`
+
+	// Array sets how arrays at Path are exported, overriding -arrays. See
+	// CheckArrayMode for the supported modes.
+	Array string `yaml:"array"`
+
+	// IDField treats arrays at Path as arrays of objects identified by this
+	// field, whose value becomes a label named IDLabel, or IDField if unset.
+	// Other fields are flattened as if the object was not in an array.
+	IDField string `yaml:"id_field"`
+	IDLabel string `yaml:"id_label"`
+
+	// ValueFields limits the fields exported from objects, if set.
+	ValueFields []string `yaml:"value_fields"`
+
+	// Exemplar maps exemplar label names to fields of the map at Path, e.g.
+	// {trace_id: TraceID}. The fields are attached as exemplar to counters in
+	// the subtree instead of being exported.
+	Exemplar map[string]string `yaml:"exemplar"`
+
+	// ExemplarValue names a numeric field of the map at Path holding the
+	// value of the observation of the exemplar, e.g. the latency of the
+	// traced request. Exemplars have the value 0 without it, since the value
+	// of the counter isn't one observation.
+	ExemplarValue string `yaml:"exemplar_value"`
+
+	// TimestampField names a field of the map at Path holding the time when
+	// the metrics in the subtree were observed, as Unix time in TimestampUnit
+	// or as RFC 3339 string. Its value is exported as sample timestamp
+	// instead of as metric.
+	TimestampField string `yaml:"timestamp_field"`
+	TimestampUnit  string `yaml:"timestamp_unit"`
+
+	// Expr is a CEL expression transforming the numbers at Path, e.g.
+	// "value / 1e9" or "has(parent.count) ? value / parent.count : 0". It
+	// gets the number as value, the map holding it as parent, which is empty
+	// for top-level expvars, and its unsanitized metric name as name. Numbers
+	// for which it fails are dropped.
+	Expr string `yaml:"expr"`
+
+	pattern []string
+	program cel.Program
+}
+
+// RenameConfig renames flattened metrics matching a regular expression.
+type RenameConfig struct {
+	// Match is an anchored regular expression over the flattened name.
+	Match string `yaml:"match"`
+
+	// Replacement is expanded with capture groups of Match, e.g. "go_$1".
+	Replacement string `yaml:"replacement"`
+
+	re *regexp.Regexp
+}
+
+var (
+	labelNameRE  = regexp.MustCompile(`^[a-zA-Z_][a-zA-Z0-9_]*$`)
+	metricNameRE = regexp.MustCompile(`^[a-zA-Z_:][a-zA-Z0-9_:]*$`)
+)
+
+// Compile validates the rules and prepares them for use.
+func (r *Rules) Compile() error {
+	r.metricsByName = make(map[string]*MetricConfig, len(r.Metrics))
+	for i, m := range r.Metrics {
+		if m.Name == "" {
+			return fmt.Errorf("metrics[%d]: missing name", i)
+		}
+		if r.metricsByName[m.Name] != nil {
+			return fmt.Errorf("metrics[%d]: duplicate name %q", i, m.Name)
+		}
+		switch m.Type {
+		case "", "counter", "gauge", "untyped":
+		default:
+			return fmt.Errorf("metric %q: unsupported type %q", m.Name, m.Type)
+		}
+		r.metricsByName[m.Name] = m
+	}
+
+	r.exprs = false
+	for i, pc := range r.Paths {
+		if pc.Path == "" {
+			return fmt.Errorf("paths[%d]: missing path", i)
+		}
+		pc.pattern = strings.Split(pc.Path, ".")
+		for _, elem := range pc.pattern {
+			if _, err := path.Match(elem, ""); err != nil {
+				return fmt.Errorf("path %q: invalid pattern %q: %w", pc.Path, elem, err)
+			}
+		}
+		if pc.KeyLabel != "" && !labelNameRE.MatchString(pc.KeyLabel) {
+			return fmt.Errorf("path %q: invalid key_label %q", pc.Path, pc.KeyLabel)
+		}
+		if _, ok := stringParsers[pc.Parse]; pc.Parse != "" && !ok {
+			return fmt.Errorf("path %q: unknown parse kind %q", pc.Path, pc.Parse)
+		}
+		if pc.Array != "" {
+			if err := CheckArrayMode(pc.Array); err != nil {
+				return fmt.Errorf("path %q: %w", pc.Path, err)
+			}
+		}
+		if pc.IDLabel == "" {
+			pc.IDLabel = pc.IDField
+		}
+		if pc.IDField != "" && !labelNameRE.MatchString(pc.IDLabel) {
+			return fmt.Errorf("path %q: invalid id_label %q", pc.Path, pc.IDLabel)
+		}
+		if _, ok := timestampUnits[pc.TimestampUnit]; pc.TimestampUnit != "" && !ok {
+			return fmt.Errorf("path %q: unknown timestamp_unit %q", pc.Path, pc.TimestampUnit)
+		}
+		if pc.ExemplarValue != "" && len(pc.Exemplar) == 0 {
+			return fmt.Errorf("path %q: exemplar_value requires exemplar", pc.Path)
+		}
+		for name, field := range pc.Exemplar {
+			if !labelNameRE.MatchString(name) {
+				return fmt.Errorf("path %q: invalid exemplar label %q", pc.Path, name)
+			}
+			if field == "" {
+				return fmt.Errorf("path %q: missing field of exemplar label %q", pc.Path, name)
+			}
+		}
+		pc.program = nil
+		if pc.Expr != "" {
+			program, err := compileExpr(pc.Expr)
+			if err != nil {
+				return fmt.Errorf("path %q: invalid expr: %w", pc.Path, err)
+			}
+			pc.program = program
+			r.exprs = true
+		}
+	}
+
+	for i, ec := range r.Extract {
+		segments, err := parseJSONPath(ec.Path)
+		if err != nil {
+			return fmt.Errorf("extract[%d]: invalid path %q: %w", i, ec.Path, err)
+		}
+		if !metricNameRE.MatchString(ec.Name) {
+			return fmt.Errorf("extract[%d]: invalid name %q", i, ec.Name)
+		}
+		if n := wildcards(segments); len(ec.Labels) != n {
+			return fmt.Errorf("extract[%d]: path %q has %d wildcards but %d labels", i, ec.Path, n, len(ec.Labels))
+		}
+		for _, label := range ec.Labels {
+			if !labelNameRE.MatchString(label) {
+				return fmt.Errorf("extract[%d]: invalid label %q", i, label)
+			}
+		}
+		ec.segments = segments
+	}
+
+	for i, rc := range r.Renames {
+		re, err := regexp.Compile("^(?:" + rc.Match + ")$")
+		if err != nil {
+			return fmt.Errorf("renames[%d]: invalid match: %w", i, err)
+		}
+		if rc.Replacement == "" {
+			return fmt.Errorf("renames[%d]: missing replacement", i)
+		}
+		rc.re = re
+	}
+
+	r.includeREs = nil
+	r.excludeREs = nil
+	return r.AddFilters(r.Include, r.Exclude)
+}
+
+// AddFilters adds include and exclude patterns, e.g. from command-line flags.
+func (r *Rules) AddFilters(include, exclude []string) error {
+	for _, pattern := range include {
+		re, err := regexp.Compile("^(?:" + pattern + ")$")
+		if err != nil {
+			return fmt.Errorf("invalid include pattern: %w", err)
+		}
+		r.includeREs = append(r.includeREs, re)
+	}
+	for _, pattern := range exclude {
+		re, err := regexp.Compile("^(?:" + pattern + ")$")
+		if err != nil {
+			return fmt.Errorf("invalid exclude pattern: %w", err)
+		}
+		r.excludeREs = append(r.excludeREs, re)
+	}
+	return nil
+}
+
+// Keep reports whether the flattened metric passes include and exclude
+// filters.
+func (r *Rules) Keep(name string) bool {
+	if r == nil {
+		return true
+	}
+	if len(r.includeREs) > 0 && !matchAny(r.includeREs, name) {
+		return false
+	}
+	return !matchAny(r.excludeREs, name)
+}
+
+func matchAny(res []*regexp.Regexp, s string) bool {
+	for _, re := range res {
+		if re.MatchString(s) {
+			return true
+		}
+	}
+	return false
+}
+
+// StripPrefix removes the first matching strip prefix from the flattened
+// metric name.
+func (r *Rules) StripPrefix(name string) string {
+	if r == nil {
+		return name
+	}
+	for _, prefix := range r.StripPrefixes {
+		rest := strings.TrimPrefix(name, prefix)
+		if rest == name || rest == "" || (rest[0] >= '0' && rest[0] <= '9') {
+			continue
+		}
+		return rest
+	}
+	return name
+}
+
+// Metric returns the metadata declared for the metric name, or nil.
+func (r *Rules) Metric(name string) *MetricConfig {
+	if r == nil {
+		return nil
+	}
+	return r.metricsByName[name]
+}
+
+// Path returns the first path config matching the expvar keys, or nil.
+func (r *Rules) Path(keys []string) *PathConfig {
+	if r == nil {
+		return nil
+	}
+	for _, pc := range r.Paths {
+		if pc.matches(keys) {
+			return pc
+		}
+	}
+	return nil
+}
+
+// hasExprs reports whether paths have expressions.
+func (r *Rules) hasExprs() bool {
+	return r != nil && r.exprs
+}
+
+// exprParent reports whether an expression applies to children of the map
+// at the path, which then needs to be decoded as a whole.
+func (r *Rules) exprParent(keys []string) bool {
+	if !r.hasExprs() {
+		return false
+	}
+	for _, pc := range r.Paths {
+		if pc.program != nil && len(pc.pattern) == len(keys)+1 && matchPattern(pc.pattern[:len(keys)], keys) {
+			return true
+		}
+	}
+	return false
+}
+
+func (pc *PathConfig) matches(keys []string) bool {
+	return matchPattern(pc.pattern, keys)
+}
+
+// matchPattern reports whether the keys match the glob patterns of a path
+// element by element.
+func matchPattern(pattern, keys []string) bool {
+	if len(keys) != len(pattern) {
+		return false
+	}
+	for i, elem := range pattern {
+		if ok, _ := path.Match(elem, keys[i]); !ok {
+			return false
+		}
+	}
+	return true
+}
+
+// isFieldOfSubtree reports whether the key of the map at the path holds the
+// exemplar or timestamp of the subtree, instead of a metric.
+func (pc *PathConfig) isFieldOfSubtree(key string) bool {
+	return pc != nil && (isExemplarField(pc.Exemplar, key) || key == pc.ExemplarValue && key != "" || key == pc.TimestampField)
+}
+
+// Rename applies the first matching rename rule to the metric name. The
+// result is not sanitized.
+func (r *Rules) Rename(name string) string {
+	if r == nil {
+		return name
+	}
+	for _, rc := range r.Renames {
+		if m := rc.re.FindStringSubmatchIndex(name); m != nil {
+			return string(rc.re.ExpandString(nil, rc.Replacement, name, m))
+		}
+	}
+	return name
+}
@@ -0,0 +1,258 @@
+package expvarcollector
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"sort"
+	"time"
+)
+
+// MetricFamily is a group of samples with the same name, as exposed in the
+// Prometheus formats.
+type MetricFamily struct {
+	Name string
+	Help string
+
+	// Type is "counter", "gauge", "histogram", "summary" or "untyped", or
+	// empty if unknown.
+	Type string
+
+	Samples []Sample
+}
+
+// Scraper scrapes the expvars of targets and translates them into metric
+// families, for programs serving them on their own. It is created with
+// NewScraper and safe for concurrent use.
+type Scraper struct {
+	client  *http.Client
+	timeout time.Duration
+	prefix  string
+	rules   Rules
+	opts    Options
+
+	converters []Converter
+	script     *Script
+}
+
+// ScraperOption configures a Scraper.
+type ScraperOption func(*Scraper)
+
+// NewScraper returns a scraper configured by the options. It fails if the
+// resulting rules are invalid, e.g. with a malformed regular expression.
+func NewScraper(options ...ScraperOption) (*Scraper, error) {
+	s := &Scraper{client: http.DefaultClient}
+	for _, o := range options {
+		o(s)
+	}
+	if err := s.rules.Compile(); err != nil {
+		return nil, err
+	}
+	s.opts.Rules = &s.rules
+	if s.script != nil {
+		s.opts.Script = s.script
+	}
+	if len(s.converters) > 0 {
+		registry := &ConverterRegistry{}
+		for _, conv := range s.converters {
+			registry.Register(conv)
+		}
+		if s.opts.Converters != nil {
+			registry.Register(s.opts.Converters)
+		}
+		s.opts.Converters = registry
+	}
+	return s, nil
+}
+
+// WithClient scrapes targets with the client instead of http.DefaultClient.
+func WithClient(client *http.Client) ScraperOption {
+	return func(s *Scraper) { s.client = client }
+}
+
+// WithTimeout limits the duration of each scrape if positive.
+func WithTimeout(timeout time.Duration) ScraperOption {
+	return func(s *Scraper) { s.timeout = timeout }
+}
+
+// WithPrefix prepends the prefix to all metric names.
+func WithPrefix(prefix string) ScraperOption {
+	return func(s *Scraper) { s.prefix = prefix }
+}
+
+// WithOptions sets the options of flattening expvars. Their rules are
+// merged into those set by the other options.
+func WithOptions(opts Options) ScraperOption {
+	return func(s *Scraper) {
+		if opts.Rules != nil {
+			WithRules(*opts.Rules)(s)
+		}
+		s.opts = opts
+	}
+}
+
+// WithConverter flattens the values matched by the converter with it,
+// instead of with the built-in conversion. Converters are tried in the
+// order of their options, before those of WithOptions.
+func WithConverter(conv Converter) ScraperOption {
+	return func(s *Scraper) { s.converters = append(s.converters, conv) }
+}
+
+// WithScript translates the expvars with the script before flattening the
+// rest.
+func WithScript(script *Script) ScraperOption {
+	return func(s *Scraper) { s.script = script }
+}
+
+// WithRules adds the metrics, paths, renames, filters, strip prefixes and
+// extract rules of the rules, e.g. as loaded from YAML.
+func WithRules(rules Rules) ScraperOption {
+	return func(s *Scraper) {
+		s.rules.Metrics = append(s.rules.Metrics, rules.Metrics...)
+		s.rules.Paths = append(s.rules.Paths, rules.Paths...)
+		s.rules.Renames = append(s.rules.Renames, rules.Renames...)
+		s.rules.Include = append(s.rules.Include, rules.Include...)
+		s.rules.Exclude = append(s.rules.Exclude, rules.Exclude...)
+		s.rules.StripPrefixes = append(s.rules.StripPrefixes, rules.StripPrefixes...)
+		s.rules.Extract = append(s.rules.Extract, rules.Extract...)
+	}
+}
+
+// WithInclude keeps only the metrics whose flattened names match one of the
+// anchored regular expressions.
+func WithInclude(patterns ...string) ScraperOption {
+	return WithRules(Rules{Include: patterns})
+}
+
+// WithExclude drops the metrics whose flattened names match one of the
+// anchored regular expressions.
+func WithExclude(patterns ...string) ScraperOption {
+	return WithRules(Rules{Exclude: patterns})
+}
+
+// WithRename renames flattened metrics matching the anchored regular
+// expression, expanding capture groups in the replacement, e.g. "go_$1".
+func WithRename(match, replacement string) ScraperOption {
+	return WithRules(Rules{Renames: []*RenameConfig{{Match: match, Replacement: replacement}}})
+}
+
+// WithKeyLabel turns the keys of the maps at the path, e.g.
+// "logs-agent.HttpDestinationStats", into values of the label instead of
+// appending them to metric names.
+func WithKeyLabel(path, label string) ScraperOption {
+	return WithRules(Rules{Paths: []*PathConfig{{Path: path, KeyLabel: label}}})
+}
+
+// WithMetric declares the help and type of the metric name as exported.
+func WithMetric(name, help, typ string) ScraperOption {
+	return WithRules(Rules{Metrics: []*MetricConfig{{Name: name, Help: help, Type: typ}}})
+}
+
+// Scrape scrapes the expvars at rawURL and returns them as metric families
+// sorted by name, with samples sorted by labels.
+func (s *Scraper) Scrape(ctx context.Context, rawURL string) ([]MetricFamily, error) {
+	if s.timeout > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, s.timeout)
+		defer cancel()
+	}
+	samples, err := fetch(ctx, s.client, rawURL, &s.opts)
+	if err != nil {
+		return nil, err
+	}
+	return Families(samples, s.opts.Rules, s.prefix), nil
+}
+
+// fetch requests the expvars at rawURL and flattens them.
+func fetch(ctx context.Context, client *http.Client, rawURL string, opts *Options) ([]Sample, error) {
+	target, err := url.Parse(rawURL)
+	if err != nil {
+		return nil, fmt.Errorf("%w; invalid URL %q: %w", ErrTargetInaccessible, rawURL, err)
+	}
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, target.String(), nil)
+	if err != nil {
+		return nil, fmt.Errorf("%w; error scraping %q: %w", ErrTargetInaccessible, target, err)
+	}
+	req.Header.Set("Accept-Encoding", AcceptEncoding)
+	resp, err := client.Do(req)
+	if err != nil {
+		return nil, fmt.Errorf("%w; error scraping %q: %w", ErrTargetInaccessible, target, err)
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		io.Copy(io.Discard, io.LimitReader(resp.Body, 4096))
+		return nil, fmt.Errorf("%w; error scraping %q: %s", ErrTargetInaccessible, target, resp.Status)
+	}
+	samples, _, err := Decode(resp, target, opts, 0)
+	return samples, err
+}
+
+// Families groups samples by name into families with the metadata declared
+// in rules or known for memstats, prepends prefix to their names, and sorts
+// them by name and samples by labels.
+func Families(samples []Sample, rules *Rules, prefix string) []MetricFamily {
+	byName := make(map[string]*MetricFamily, len(samples))
+	for _, s := range samples {
+		mf := byName[s.Name]
+		if mf == nil {
+			mf = &MetricFamily{Name: s.Name}
+			if m := metricConfig(rules, s); m != nil {
+				mf.Help = m.Help
+				mf.Type = m.Type
+			}
+			if s.Histogram != nil {
+				mf.Type = "histogram"
+			}
+			if s.Summary != nil {
+				mf.Type = "summary"
+			}
+			byName[s.Name] = mf
+		}
+		s.Name = prefix + s.Name
+		mf.Samples = append(mf.Samples, s)
+	}
+
+	families := make([]MetricFamily, 0, len(byName))
+	for _, mf := range byName {
+		mf.Name = prefix + mf.Name
+		SortSamples(mf.Samples)
+		families = append(families, *mf)
+	}
+	sort.Slice(families, func(i, j int) bool {
+		return families[i].Name < families[j].Name
+	})
+	return families
+}
+
+// metricConfig returns the metadata of the sample declared in rules, by
+// itself or known for memstats, or nil.
+func metricConfig(rules *Rules, s Sample) *MetricConfig {
+	if m := rules.Metric(s.Name); m != nil {
+		return m
+	}
+	if s.Meta != nil {
+		return s.Meta
+	}
+	return GoMetric(s.Name)
+}
+
+// SortSamples sorts samples of the same family by labels.
+func SortSamples(samples []Sample) {
+	sort.Slice(samples, func(i, j int) bool {
+		return labelsLess(samples[i].Labels, samples[j].Labels)
+	})
+}
+
+func labelsLess(a, b []Label) bool {
+	for i := 0; i < len(a) && i < len(b); i++ {
+		if a[i].Name != b[i].Name {
+			return a[i].Name < b[i].Name
+		}
+		if a[i].Value != b[i].Value {
+			return a[i].Value < b[i].Value
+		}
+	}
+	return len(a) < len(b)
+}
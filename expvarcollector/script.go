@@ -0,0 +1,295 @@
+package expvarcollector
+
+import (
+	"encoding/json"
+	"fmt"
+	"log/slog"
+	"math"
+	"sort"
+	"strconv"
+
+	"go.starlark.net/starlark"
+	"go.starlark.net/syntax"
+)
+
+// scriptMaxSteps bounds the computation of a script per scrape, so that a
+// script stuck in a loop fails the scrape instead of hanging it.
+const scriptMaxSteps = 100_000_000
+
+// Script is a Starlark script translating expvars that rules can't express,
+// like reshaped subtrees or histograms. It defines a function
+//
+//	def metrics(expvars):
+//	    return [{"name": "queue_length", "type": "gauge", "samples": [
+//	        {"labels": {"queue": q}, "value": v["len"]} for q, v in expvars.pop("queues").items()]}]
+//
+// which receives the decoded expvars as a dict and returns a list of metric
+// families. Families have a name, an optional help and type, one of
+// "counter", "gauge", "untyped" or "histogram", and samples with optional
+// labels and either a value, or buckets as a dict of upper bounds to
+// cumulative counts, a count and a sum for histograms. Top-level expvars
+// left in the dict are flattened as usual, so the script should pop those it
+// translates.
+type Script struct {
+	filename string
+	metrics  starlark.Callable
+}
+
+// LoadScript loads the Starlark script in the file.
+func LoadScript(filename string) (*Script, error) {
+	thread := &starlark.Thread{Name: "load", Print: scriptPrint}
+	globals, err := starlark.ExecFileOptions(&syntax.FileOptions{}, thread, filename, nil, nil)
+	if err != nil {
+		return nil, fmt.Errorf("error loading script: %w", err)
+	}
+	globals.Freeze()
+	metrics, ok := globals["metrics"].(starlark.Callable)
+	if !ok {
+		return nil, fmt.Errorf("script %q doesn't define a function metrics(expvars)", filename)
+	}
+	return &Script{filename: filename, metrics: metrics}, nil
+}
+
+func scriptPrint(thread *starlark.Thread, msg string) {
+	slog.Debug("script output", "thread", thread.Name, "msg", msg)
+}
+
+// run calls the script with the expvars and returns the samples of the
+// families it returned, and the expvars it left to be flattened as usual.
+func (s *Script) run(target string, expvars map[string]interface{}) ([]Sample, map[string]interface{}, error) {
+	thread := &starlark.Thread{Name: target, Print: scriptPrint}
+	thread.SetMaxExecutionSteps(scriptMaxSteps)
+	dict := scriptValue(expvars).(*starlark.Dict)
+	result, err := starlark.Call(thread, s.metrics, starlark.Tuple{dict}, nil)
+	if err != nil {
+		return nil, nil, fmt.Errorf("error running script %q: %w", s.filename, err)
+	}
+	samples, err := scriptSamples(result)
+	if err != nil {
+		return nil, nil, fmt.Errorf("invalid result of script %q: %w", s.filename, err)
+	}
+
+	rest := make(map[string]interface{}, dict.Len())
+	for k, v := range expvars {
+		if _, found, _ := dict.Get(starlark.String(k)); found {
+			rest[k] = v
+		}
+	}
+	return samples, rest, nil
+}
+
+// scriptValue converts decoded JSON into Starlark values. Integers stay
+// integers, so that the script can use them as indexes.
+func scriptValue(v interface{}) starlark.Value {
+	switch v := v.(type) {
+	case json.Number:
+		if i, err := strconv.ParseInt(string(v), 10, 64); err == nil {
+			return starlark.MakeInt64(i)
+		}
+		return starlark.Float(valToFloat(v))
+	case bool:
+		return starlark.Bool(v)
+	case string:
+		return starlark.String(v)
+	case []interface{}:
+		elems := make([]starlark.Value, len(v))
+		for i, e := range v {
+			elems[i] = scriptValue(e)
+		}
+		return starlark.NewList(elems)
+	case map[string]interface{}:
+		keys := make([]string, 0, len(v))
+		for k := range v {
+			keys = append(keys, k)
+		}
+		sort.Strings(keys)
+		d := starlark.NewDict(len(v))
+		for _, k := range keys {
+			d.SetKey(starlark.String(k), scriptValue(v[k]))
+		}
+		return d
+	}
+	return starlark.None
+}
+
+// scriptSamples converts the metric families returned by a script into
+// samples.
+func scriptSamples(result starlark.Value) ([]Sample, error) {
+	families, ok := result.(*starlark.List)
+	if !ok {
+		return nil, fmt.Errorf("got %s instead of a list of metric families", result.Type())
+	}
+	var samples []Sample
+	for i := 0; i < families.Len(); i++ {
+		family, ok := families.Index(i).(*starlark.Dict)
+		if !ok {
+			return nil, fmt.Errorf("family %d: got %s instead of a dict", i, families.Index(i).Type())
+		}
+		meta := &MetricConfig{}
+		if err := scriptFields(family, map[string]*string{"name": &meta.Name, "help": &meta.Help, "type": &meta.Type}); err != nil {
+			return nil, fmt.Errorf("family %d: %w", i, err)
+		}
+		switch meta.Type {
+		case "", "counter", "gauge", "untyped", "histogram":
+		default:
+			return nil, fmt.Errorf("family %q: unsupported type %q", meta.Name, meta.Type)
+		}
+		if meta.Name == "" {
+			return nil, fmt.Errorf("family %d: missing name", i)
+		}
+
+		v, _, _ := family.Get(starlark.String("samples"))
+		list, ok := v.(*starlark.List)
+		if !ok {
+			return nil, fmt.Errorf("family %q: missing list of samples", meta.Name)
+		}
+		for j := 0; j < list.Len(); j++ {
+			s, err := scriptSample(list.Index(j), meta)
+			if err != nil {
+				return nil, fmt.Errorf("family %q: sample %d: %w", meta.Name, j, err)
+			}
+			samples = append(samples, s)
+		}
+	}
+	return samples, nil
+}
+
+// scriptSample converts a sample of a family returned by a script.
+func scriptSample(v starlark.Value, meta *MetricConfig) (Sample, error) {
+	d, ok := v.(*starlark.Dict)
+	if !ok {
+		return Sample{}, fmt.Errorf("got %s instead of a dict", v.Type())
+	}
+	s := Sample{Name: meta.Name, Meta: meta}
+
+	if v, found, _ := d.Get(starlark.String("labels")); found {
+		labels, ok := v.(*starlark.Dict)
+		if !ok {
+			return Sample{}, fmt.Errorf("labels: got %s instead of a dict", v.Type())
+		}
+		for _, item := range labels.Items() {
+			name, ok := starlark.AsString(item[0])
+			if !ok || !labelNameRE.MatchString(name) {
+				return Sample{}, fmt.Errorf("invalid label name %s", item[0])
+			}
+			value, ok := starlark.AsString(item[1])
+			if !ok {
+				value = item[1].String()
+			}
+			s.Labels = append(s.Labels, Label{Name: name, Value: value})
+		}
+		SortLabels(s.Labels)
+	}
+
+	if meta.Type != "histogram" {
+		value, err := scriptFloat(d, "value")
+		if err != nil {
+			return Sample{}, err
+		}
+		s.Value = value
+		return s, nil
+	}
+
+	// Scripts only give classic buckets, so Native stays nil and the histogram
+	// is exposed without native buckets.
+	h := &Histogram{}
+	v, _, _ = d.Get(starlark.String("buckets"))
+	buckets, ok := v.(*starlark.Dict)
+	if !ok {
+		return Sample{}, fmt.Errorf("missing dict of buckets")
+	}
+	for _, item := range buckets.Items() {
+		bound, ok := starlark.AsFloat(item[0])
+		if !ok {
+			return Sample{}, fmt.Errorf("bucket bound %s isn't a number", item[0])
+		}
+		if math.IsInf(bound, 1) {
+			continue
+		}
+		count, ok := starlark.AsFloat(item[1])
+		if !ok || count < 0 {
+			return Sample{}, fmt.Errorf("count %s of bucket %v isn't a non-negative number", item[1], bound)
+		}
+		h.Bounds = append(h.Bounds, bound)
+		h.Counts = append(h.Counts, uint64(count))
+	}
+	sort.Sort(byBound{h})
+	count, err := scriptFloat(d, "count")
+	if err != nil {
+		return Sample{}, err
+	}
+	h.Count = uint64(count)
+	if h.Sum, err = scriptFloat(d, "sum"); err != nil {
+		return Sample{}, err
+	}
+	s.Histogram = h
+	return s, nil
+}
+
+// scriptFields sets the optional string fields of a dict.
+func scriptFields(d *starlark.Dict, fields map[string]*string) error {
+	for key, field := range fields {
+		v, found, _ := d.Get(starlark.String(key))
+		if !found {
+			continue
+		}
+		s, ok := starlark.AsString(v)
+		if !ok {
+			return fmt.Errorf("%s: got %s instead of a string", key, v.Type())
+		}
+		*field = s
+	}
+	return nil
+}
+
+// scriptFloat returns the number or bool in the field of a dict.
+func scriptFloat(d *starlark.Dict, key string) (float64, error) {
+	v, found, _ := d.Get(starlark.String(key))
+	if !found {
+		return 0, fmt.Errorf("missing %s", key)
+	}
+	if b, ok := v.(starlark.Bool); ok {
+		return valToFloat(bool(b)), nil
+	}
+	f, ok := starlark.AsFloat(v)
+	if !ok {
+		return 0, fmt.Errorf("%s: got %s instead of a number", key, v.Type())
+	}
+	return f, nil
+}
+
+// byBound sorts the buckets of a histogram by upper bound.
+type byBound struct{ h *Histogram }
+
+func (b byBound) Len() int           { return len(b.h.Bounds) }
+func (b byBound) Less(i, j int) bool { return b.h.Bounds[i] < b.h.Bounds[j] }
+func (b byBound) Swap(i, j int) {
+	b.h.Bounds[i], b.h.Bounds[j] = b.h.Bounds[j], b.h.Bounds[i]
+	b.h.Counts[i], b.h.Counts[j] = b.h.Counts[j], b.h.Counts[i]
+}
+
+// collectScript decodes the expvars read from dec as a whole, translates
+// them with the script and flattens the rest.
+func (c *collector) collectScript(dec *json.Decoder, script *Script) error {
+	var v interface{}
+	if err := dec.Decode(&v); err != nil {
+		return err
+	}
+	expvars, ok := v.(map[string]interface{})
+	if !ok {
+		return fmt.Errorf("expvars must be a JSON object")
+	}
+	samples, rest, err := script.run(c.target, expvars)
+	if err != nil {
+		c.fail(err)
+		return nil
+	}
+	for _, s := range samples {
+		c.add(s)
+	}
+	for k, v := range rest {
+		c.extract(k, v)
+		c.collectMetrics([]string{k}, k, nil, v)
+	}
+	return nil
+}
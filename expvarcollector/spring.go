@@ -0,0 +1,90 @@
+package expvarcollector
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/url"
+	"strings"
+)
+
+// springMetric is the response of /actuator/metrics/{name} of Spring Boot.
+type springMetric struct {
+	Name         string `json:"name"`
+	Description  string `json:"description"`
+	BaseUnit     string `json:"baseUnit"`
+	Measurements []struct {
+		Statistic string      `json:"statistic"`
+		Value     json.Number `json:"value"`
+	} `json:"measurements"`
+}
+
+// springStatistics maps the statistics of measurements to the suffixes and
+// types of metrics, following the Prometheus registry of Micrometer.
+var springStatistics = map[string]struct{ suffix, typ string }{
+	"VALUE":        {"", "gauge"},
+	"COUNT":        {"_count", "counter"},
+	"TOTAL":        {"_sum", "counter"},
+	"TOTAL_TIME":   {"_sum", "counter"},
+	"MAX":          {"_max", "gauge"},
+	"ACTIVE_TASKS": {"_active_count", "gauge"},
+	"DURATION":     {"_duration_sum", "gauge"},
+}
+
+// collectSpringActuator flattens a metric of Spring Boot actuator, e.g.
+//
+//	{"name": "jvm.memory.used", "baseUnit": "bytes",
+//	 "measurements": [{"statistic": "VALUE", "value": 1.2e8}],
+//	 "availableTags": [{"tag": "area", "values": ["heap", "nonheap"]}]}
+//
+// into jvm_memory_used_bytes 1.2e8. The measurements of actuator are summed
+// over all values of the available tags, so a single value is selected with
+// tag parameters in the URL of the target, like
+// "/actuator/metrics/jvm.memory.used?tag=area:heap", which become labels.
+func (c *collector) collectSpringActuator(dec *json.Decoder, target *url.URL) error {
+	var m springMetric
+	if err := dec.Decode(&m); err != nil {
+		return err
+	}
+	if m.Name == "" {
+		c.fail(fmt.Errorf("missing name of actuator metric"))
+		return nil
+	}
+
+	var labels []Label
+	for _, tag := range target.Query()["tag"] {
+		name, value, ok := strings.Cut(tag, ":")
+		if !ok || !labelNameRE.MatchString(name) {
+			continue
+		}
+		labels = append(labels, Label{Name: name, Value: value})
+	}
+	SortLabels(labels)
+
+	base := m.Name
+	if unit := strings.ToLower(m.BaseUnit); unit != "" && !strings.HasSuffix(base, "."+unit) {
+		base += "_" + unit
+	}
+	for _, meas := range m.Measurements {
+		stat, ok := springStatistics[meas.Statistic]
+		if !ok {
+			stat.suffix = "_" + strings.ToLower(meas.Statistic)
+		}
+		name := base + stat.suffix
+		if meas.Statistic == "COUNT" && len(m.Measurements) == 1 {
+			// A counter on its own rather than the count of a timer.
+			name = base + "_total"
+		}
+		v, err := meas.Value.Float64()
+		if err != nil {
+			c.fail(fmt.Errorf("invalid value of statistic %s of %q: %w", meas.Statistic, m.Name, err))
+			return nil
+		}
+		c.add(Sample{
+			Name:   name,
+			Labels: labels,
+			Value:  v,
+			Meta:   &MetricConfig{Name: name, Help: m.Description, Type: stat.typ},
+		})
+	}
+	return nil
+}
@@ -0,0 +1,141 @@
+package expvarcollector
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// stringParser converts a string expvar into a sample value. Suffix is
+// appended to the metric name of parsed values.
+type stringParser struct {
+	Suffix string
+	Parse  func(s string) (float64, bool)
+
+	// ValueLabel keeps the string as value of this label, if set.
+	ValueLabel string
+}
+
+// stringParsers are the kinds accepted by -strings.parse and "parse" of path
+// configs.
+var stringParsers = map[string]stringParser{
+	"number":    {Parse: parseNumber},
+	"duration":  {Suffix: "_seconds", Parse: parseDuration},
+	"timestamp": {Suffix: "_timestamp_seconds", Parse: parseTimestamp},
+	"size":      {Suffix: "_bytes", Parse: parseSize},
+	"bool":      {Parse: parseBool},
+	"info":      {Suffix: "_info", Parse: parseInfo, ValueLabel: "value"},
+}
+
+// ParseStringKinds parses a comma-separated list of string kinds.
+func ParseStringKinds(list string) ([]string, error) {
+	var kinds []string
+	for _, kind := range strings.Split(list, ",") {
+		kind = strings.TrimSpace(kind)
+		if kind == "" {
+			continue
+		}
+		if _, ok := stringParsers[kind]; !ok {
+			return nil, fmt.Errorf("unknown string kind %q", kind)
+		}
+		kinds = append(kinds, kind)
+	}
+	return kinds, nil
+}
+
+// collectString converts a string expvar by the first matching kind
+// configured for the path, or by the global kinds. Unparsable strings are
+// dropped.
+func (c *collector) collectString(path []string, name string, labels []Label, v string) {
+	kinds := c.StringKinds
+	if pc := c.Rules.Path(path); pc != nil && pc.Parse != "" {
+		kinds = []string{pc.Parse}
+	}
+	for _, kind := range kinds {
+		sp := stringParsers[kind]
+		if f, ok := sp.Parse(v); ok {
+			if !strings.HasSuffix(name, sp.Suffix) {
+				name += sp.Suffix
+			}
+			if sp.ValueLabel != "" {
+				labels = append(labels[:len(labels):len(labels)], Label{Name: sp.ValueLabel, Value: v})
+			}
+			c.addValue(path, name, labels, f)
+			return
+		}
+	}
+}
+
+func parseNumber(s string) (float64, bool) {
+	f, err := strconv.ParseFloat(strings.TrimSpace(s), 64)
+	return f, err == nil
+}
+
+// parseDuration parses Go durations like "1h2m3s" into seconds.
+func parseDuration(s string) (float64, bool) {
+	d, err := time.ParseDuration(strings.TrimSpace(s))
+	return d.Seconds(), err == nil
+}
+
+// parseTimestamp parses RFC 3339 timestamps into seconds since the epoch.
+func parseTimestamp(s string) (float64, bool) {
+	t, err := time.Parse(time.RFC3339Nano, strings.TrimSpace(s))
+	if err != nil {
+		return 0, false
+	}
+	return float64(t.UnixNano()) / 1e9, true
+}
+
+// sizeUnits are the multipliers of units accepted by parseSize, in lower case.
+var sizeUnits = map[string]float64{
+	"b":   1,
+	"kb":  1e3,
+	"mb":  1e6,
+	"gb":  1e9,
+	"tb":  1e12,
+	"pb":  1e15,
+	"kib": 1 << 10,
+	"mib": 1 << 20,
+	"gib": 1 << 30,
+	"tib": 1 << 40,
+	"pib": 1 << 50,
+}
+
+// parseSize parses sizes like "12.5MB" or "3 GiB" into bytes. A unit is
+// required, so that plain numbers are left to the "number" kind.
+func parseSize(s string) (float64, bool) {
+	s = strings.TrimSpace(s)
+	i := strings.IndexFunc(s, func(r rune) bool {
+		return (r < '0' || r > '9') && r != '.'
+	})
+	if i <= 0 {
+		return 0, false
+	}
+	f, err := strconv.ParseFloat(s[:i], 64)
+	if err != nil {
+		return 0, false
+	}
+	scale, ok := sizeUnits[strings.ToLower(strings.TrimSpace(s[i:]))]
+	if !ok {
+		return 0, false
+	}
+	return f * scale, true
+}
+
+// parseBool parses "true" and "false" in any case into 1 and 0, like real
+// booleans.
+func parseBool(s string) (float64, bool) {
+	switch strings.ToLower(strings.TrimSpace(s)) {
+	case "true":
+		return valToFloat(true), true
+	case "false":
+		return valToFloat(false), true
+	}
+	return 0, false
+}
+
+// parseInfo accepts any string, to be exported as info metric with value 1.
+func parseInfo(s string) (float64, bool) {
+	return 1, true
+}
@@ -0,0 +1,44 @@
+package expvarcollector
+
+import (
+	"encoding/json"
+	"math"
+	"strconv"
+	"time"
+)
+
+// timestampUnits are the supported values of timestamp_unit, as number of
+// milliseconds per unit. Seconds are the default.
+var timestampUnits = map[string]float64{
+	"s":  1e3,
+	"ms": 1,
+	"us": 1e-3,
+	"ns": 1e-6,
+}
+
+// timestampMs returns the timestamp in milliseconds found in the configured
+// field of the map m, or 0 if there is none.
+func timestampMs(pc *PathConfig, m map[string]interface{}) int64 {
+	if pc.TimestampField == "" {
+		return 0
+	}
+	switch v := m[pc.TimestampField].(type) {
+	case json.Number:
+		f, err := strconv.ParseFloat(string(v), 64)
+		if err != nil || f <= 0 {
+			return 0
+		}
+		perUnit, ok := timestampUnits[pc.TimestampUnit]
+		if !ok {
+			perUnit = timestampUnits["s"]
+		}
+		return int64(math.Round(f * perUnit))
+	case string:
+		t, err := time.Parse(time.RFC3339Nano, v)
+		if err != nil {
+			return 0
+		}
+		return t.UnixMilli()
+	}
+	return 0
+}
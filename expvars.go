@@ -0,0 +1,25 @@
+package main
+
+import (
+	"expvar"
+)
+
+// Internal counters of the proxy, published with expvar at /debug/vars, so
+// that the proxy can be debugged with curl or even scrape itself.
+var (
+	expvarStats = expvar.NewMap("expvar_proxy")
+
+	expvarScrapes      = new(expvar.Int) // requests to targets, not counting retries
+	expvarScrapeErrors = new(expvar.Int) // failed scrapes, e.g. parse errors
+	expvarParseErrors  = new(expvar.Int) // bodies of targets failing to decode or convert
+	expvarCacheHits    = new(expvar.Int) // scrapes served by the cache or shared with other requests
+	expvarCacheMisses  = new(expvar.Int)
+)
+
+func init() {
+	expvarStats.Set("scrapes", expvarScrapes)
+	expvarStats.Set("scrape_errors", expvarScrapeErrors)
+	expvarStats.Set("parse_errors", expvarParseErrors)
+	expvarStats.Set("cache_hits", expvarCacheHits)
+	expvarStats.Set("cache_misses", expvarCacheMisses)
+}
@@ -0,0 +1,32 @@
+package main
+
+import (
+	"io"
+	"net/http"
+)
+
+// isHealthCheck returns whether the request is for /-/healthy or /-/ready,
+// which are used by orchestrators rather than scrapers.
+func isHealthCheck(req *http.Request) bool {
+	return !req.URL.IsAbs() && (req.URL.Path == "/-/healthy" || req.URL.Path == "/-/ready")
+}
+
+// serveHealthy answers health checks, as long as the proxy is serving at all.
+func serveHealthy(wr http.ResponseWriter, _ *http.Request) {
+	io.WriteString(wr, "Healthy.\n")
+}
+
+// Readiness answers readiness checks once configured targets scraped in the
+// background got their first scrape. The config is loaded before serving.
+type Readiness struct {
+	Scheduler *Scheduler
+}
+
+func (r *Readiness) ServeHTTP(wr http.ResponseWriter, _ *http.Request) {
+	if !r.Scheduler.Ready() {
+		wr.WriteHeader(http.StatusServiceUnavailable)
+		io.WriteString(wr, "Not ready: waiting for the first scrape of targets.\n")
+		return
+	}
+	io.WriteString(wr, "Ready.\n")
+}
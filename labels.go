@@ -0,0 +1,61 @@
+package main
+
+import (
+	"fmt"
+	"net/url"
+	"strings"
+
+	"github.com/relex/prometheus-expvar-proxy/expvarcollector"
+)
+
+// labelParamPrefix marks query parameters of proxy and probe requests that
+// set target labels, e.g. "__label_env=prod". They are not sent upstream.
+const labelParamPrefix = "__label_"
+
+// extractLabelParams removes label parameters from the query and returns them
+// as labels.
+func extractLabelParams(query url.Values) ([]Label, error) {
+	var labels []Label
+	for key, values := range query {
+		if !strings.HasPrefix(key, labelParamPrefix) {
+			continue
+		}
+		name := strings.TrimPrefix(key, labelParamPrefix)
+		if !labelNameRE.MatchString(name) {
+			return nil, fmt.Errorf("invalid label name %q in parameter %q", name, key)
+		}
+		labels = append(labels, Label{Name: name, Value: values[len(values)-1]})
+		query.Del(key)
+	}
+	expvarcollector.SortLabels(labels)
+	return labels, nil
+}
+
+// addTargetLabels adds target labels to all samples. Labels already present
+// in a sample, e.g. from key_label, take precedence.
+func addTargetLabels(samples []sample, labels []Label) []sample {
+	if len(labels) == 0 {
+		return samples
+	}
+	for i := range samples {
+		s := &samples[i]
+		merged := make([]Label, 0, len(labels)+len(s.Labels))
+		for _, l := range labels {
+			if !hasLabel(s.Labels, l.Name) {
+				merged = append(merged, l)
+			}
+		}
+		s.Labels = append(merged, s.Labels...)
+		expvarcollector.SortLabels(s.Labels)
+	}
+	return samples
+}
+
+func hasLabel(labels []Label, name string) bool {
+	for _, l := range labels {
+		if l.Name == name {
+			return true
+		}
+	}
+	return false
+}
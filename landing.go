@@ -0,0 +1,35 @@
+package main
+
+import (
+	"net/http"
+
+	"github.com/prometheus/common/version"
+	"github.com/prometheus/exporter-toolkit/web"
+)
+
+// newLandingPage returns the HTML page served at "/", which links the
+// endpoints of the exporter. /metrics is only listed if configured targets
+// are exported.
+func newLandingPage(metrics bool) (http.Handler, error) {
+	links := []web.LandingLinks{
+		{Address: "/probe?target=", Text: "Probe", Description: "Expvars of a target given by ?target="},
+		{Address: "/-/healthy", Text: "Health"},
+		{Address: "/-/ready", Text: "Readiness"},
+	}
+	if metrics {
+		links = append([]web.LandingLinks{{Address: "/metrics", Text: "Metrics", Description: "Expvars of the configured targets"}}, links...)
+	}
+	return web.NewLandingPage(web.LandingConfig{
+		Name:        "Expvar Proxy",
+		Description: "Prometheus exporter and proxy of Go expvars",
+		Version:     version.Info(),
+		Form: web.LandingForm{
+			Action: "/probe",
+			Inputs: []web.LandingFormInput{
+				{Label: "Target", Type: "text", Name: "target", Placeholder: "host:port"},
+			},
+		},
+		Links:     links,
+		Profiling: "false",
+	})
+}
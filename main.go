@@ -1,189 +1,676 @@
 package main
 
 import (
-	"encoding/json"
+	"context"
 	"errors"
+	"expvar"
 	"flag"
 	"fmt"
-	"io"
-	"log"
+	"log/slog"
+	"net"
 	"net/http"
-	"net/url"
-	"regexp"
-	"sort"
-	"strings"
+	"os"
+	"os/signal"
+	"strconv"
+	"sync/atomic"
+	"syscall"
 	"time"
-	"unicode"
 
-	"golang.org/x/exp/maps"
+	"github.com/coreos/go-systemd/v22/daemon"
+	"github.com/prometheus/common/model"
+	"github.com/prometheus/common/version"
+	"github.com/prometheus/exporter-toolkit/web"
+	"github.com/relex/prometheus-expvar-proxy/expvarcollector"
+	"go.opentelemetry.io/otel/attribute"
+	semconv "go.opentelemetry.io/otel/semconv/v1.43.0"
+	"go.opentelemetry.io/otel/trace"
 )
 
 var (
-	configAddr    = flag.String("addr", "127.0.0.1:8000", "Address to listen proxy requests, e.g. 0.0.0.0:8000.")
-	configTimeout = flag.Duration("timeout", 30*time.Second, "HTTP client timeout.")
+	configAddr      = flag.String("addr", "127.0.0.1:8000", "Address to listen proxy requests, e.g. 0.0.0.0:8000.")
+	configTimeout   = flag.Duration("timeout", 30*time.Second, "HTTP client timeout.")
+	configFile      = flag.String("config.file", "", "Path to YAML config file of static targets served at /metrics (optional).")
+	configSingle    = flag.Bool("config.single-target-unlabeled", false, "Serve the only target of -config.file at /metrics without target and instance labels, as before targets were merged. Otherwise /metrics without a target parameter always serves all targets merged and labeled. Ignored with -shard.total.")
+	configProbe     = flag.String("probe.path", "/debug/vars", "Default path of targets given to /probe without a path.")
+	configWeb       = flag.String("web.config.file", "", "Path to a web config file of exporter-toolkit to serve HTTPS or require authentication (optional).")
+	configLifecycle = flag.Bool("web.enable-lifecycle", false, "Enable reloading the config file by POST to /-/reload, in addition to SIGHUP.")
+	configDrain     = flag.Duration("web.drain-timeout", 30*time.Second, "Maximum time to let requests in flight finish on SIGTERM or SIGINT before exiting.")
+	configVersion   = flag.Bool("version", false, "Print the version and exit.")
+
+	configLogLevel        = flag.String("log.level", "info", "Only log messages with the given severity or above: debug, info, warn or error.")
+	configLogFormat       = flag.String("log.format", LogFormatText, "Format of log lines: text or json.")
+	configAccessLog       = flag.String("web.access-log", "", "File to log requests to, - for stdout, or empty to disable the access log.")
+	configAccessLogFormat = flag.String("web.access-log-format", AccessLogCommon, "Format of the access log: common, combined, or a Go template like '{{.Host}} {{.Method}} {{.URI}} {{.Status}} {{.Duration}}'.")
+	configTelemetry       = flag.String("web.telemetry-path", "/-/metrics", "Path to serve the metrics of the proxy itself, or empty to disable them.")
+	configPprof           = flag.Bool("web.enable-pprof", false, "Serve the profiles of net/http/pprof at /debug/pprof/ on -web.pprof-address.")
+	configPprofAddr       = flag.String("web.pprof-address", "127.0.0.1:6060", "Address to serve pprof on, separately from proxy requests. Keep it localhost-only or otherwise restricted to admins.")
+
+	configTracingEndpoint = flag.String("tracing.endpoint", "", "URL of an OTLP/HTTP collector to export traces of requests and scrapes to, e.g. http://localhost:4318, or empty to disable tracing.")
+	configTracingRatio    = flag.Float64("tracing.sample-ratio", 1, "Ratio of traces to sample, unless sampled by the caller already.")
+
+	configCAFile             = flag.String("tls.ca-file", "", "Path to a PEM bundle of CAs to verify https:// targets with, instead of the CAs of the system (optional).")
+	configInsecureSkipVerify = flag.Bool("tls.insecure-skip-verify", false, "Disable the verification of certificates of https:// targets. Insecure, for development only.")
+
+	configAllowedClients = flag.String("web.allowed-clients", "", "Comma-separated CIDRs or IP addresses of clients allowed to use the proxy, e.g. 10.0.0.0/8, or empty to allow all. Others get 403.")
+
+	configAllowedTargets = flag.String("targets.allow", "", "Comma-separated glob patterns of host:port of targets given by clients that may be scraped, e.g. '*.internal:8080,10.1.*:*', or empty to allow all. Doesn't apply to configured targets.")
+	configDenyPrivate    = flag.Bool("targets.deny-private-networks", false, "Refuse to connect to loopback, private and link-local addresses, so that clients can't use the proxy, e.g. in proxy mode and /probe, to reach internal services. Applies to configured targets too, except on unix sockets, and drops HTTP_PROXY and HTTPS_PROXY.")
+
+	configRateLimit       = flag.Float64("rate.limit", 0, "Maximum number of incoming requests per second, or 0 for no limit. Further requests fail with 429.")
+	configClientRateLimit = flag.Float64("rate.client-limit", 0, "Maximum number of incoming requests per second from each client address, or 0 for no limit.")
+	configRateBurst       = flag.Int("rate.burst", 10, "Number of requests allowed in a burst above -rate.limit and -rate.client-limit.")
+
+	configMaxBody       = flag.Int64("scrape.max-body-size", 64<<20, "Maximum size in bytes of decompressed responses from targets, or 0 for no limit.")
+	configMaxDepth      = flag.Int("scrape.max-depth", 64, "Maximum nesting depth of expvars, or 0 for no limit.")
+	configMaxSamples    = flag.Int("scrape.max-samples", 100000, "Maximum number of metrics per scrape, or 0 for no limit.")
+	configCacheTTL      = flag.Duration("scrape.cache-ttl", 0, "Duration to reuse the result of a scrape for further requests of the same target, e.g. 5s, or 0 to only share scrapes in flight.")
+	configRetries       = flag.Int("scrape.retries", 0, "Number of times to retry scrapes failing with connection errors or 5xx responses, within -timeout.")
+	configRetryBackoff  = flag.Duration("scrape.retry-backoff", 100*time.Millisecond, "Time to wait before the first retry, doubled for each further retry.")
+	configRetryJitter   = flag.Float64("scrape.retry-jitter", 0.2, "Fraction by which retry backoffs are randomly changed, so that retries of many scrapes are spread.")
+	configTimeoutOffset = flag.Duration("scrape.timeout-offset", 500*time.Millisecond, "Time subtracted from the X-Prometheus-Scrape-Timeout-Seconds header of scrapers to get the timeout of target requests, if less than -timeout.")
+	configInterval      = flag.Duration("scrape.interval", 0, "Interval to scrape configured targets in the background, so that /metrics serves their latest result instantly, or 0 to scrape on request.")
+	configStaleGrace    = flag.Duration("scrape.stale-grace", 0, "Duration to serve the last successful result of a target if scrapes fail, with expvar_stale=1 and expvar_up=0, or 0 to fail.")
+
+	configShardIndex = flag.Int("shard.index", 0, "Index of this replica among -shard.total, from 0.")
+	configShardTotal = flag.Int("shard.total", 1, "Number of replicas splitting the configured targets between them by the hashmod of their names, each serving and scraping only its own.")
+
+	configMaxConcurrent = flag.Int("max.concurrent-scrapes", 0, "Maximum number of simultaneous upstream scrapes, or 0 for no limit. Further scrapes wait in a queue.")
+	configMaxQueued     = flag.Int("max.queued-scrapes", 0, "Maximum number of scrapes waiting for -max.concurrent-scrapes, or 0 for no limit. Further scrapes fail with 503.")
+
+	configPrefix  = flag.String("metric.prefix", "", "Prefix of all produced metric names, e.g. myapp_ (optional).")
+	configInclude = flag.String("metric.include", "", "Regular expression of flattened metric names to keep, e.g. 'memstats_.*' (optional).")
+	configExclude = flag.String("metric.exclude", "", "Regular expression of flattened metric names to drop, e.g. 'memstats_BySize_.*' (optional).")
+
+	configGoMemstats = flag.Bool("memstats.go-names", false, "Translate the memstats expvar into the standard go_memstats_* metrics of client_golang.")
+	configBySize     = flag.Bool("memstats.by-size", true, "Export memstats.BySize as go_memstats_by_size_*{size=...} series.")
+
+	configDecimals  = flag.Int("values.decimals", -1, "Round values to this number of decimal places, e.g. 6 for the output of older versions, or -1 to keep them exact.")
+	configNonFinite = flag.String("values.non-finite", expvarcollector.NonFiniteKeep, "What to do with NaN and infinite values: keep, drop the sample, or clamp infinities to the largest float and drop NaN.")
+	configNative    = flag.Bool("histograms.native", false, "Add native buckets to synthesized histograms like go_gc_pause_seconds, if scraped in the protobuf format.")
+
+	configArrayMode     = flag.String("arrays", expvarcollector.ArrayDrop, "How to export arrays of numbers: drop, index to label elements by index, or aggregate into _min, _max, _sum, _avg and _count.")
+	configNonASCII      = flag.String("names.non-ascii", expvarcollector.NonASCIIFail, "What to do with non-ASCII characters in metric names: fail the scrape, transliterate, replace with _, drop the metric, or keep as utf8.")
+	configSnakeCase     = flag.Bool("names.snake-case", false, "Convert CamelCase expvar keys into snake_case, e.g. BytesSent to bytes_sent.")
+	configStripPrefix   = flag.String("names.strip-prefix", "", "Prefix to remove from flattened metric names, e.g. stats_ (optional).")
+	configNameCacheSize = flag.Int("names.cache-size", 100000, "Number of metric names to cache across scrapes, or 0 to disable the cache.")
+	configCollisions    = flag.String("names.collisions", expvarcollector.CollisionSuffix, "How to resolve different expvar keys producing the same metric: suffix with _2, _3..., or label with expvar_key.")
+	configCmdlineInfo   = flag.Bool("cmdline.info", false, "Export the cmdline expvar as expvar_cmdline_info{cmdline=...}. Off by default, as command lines often contain passwords and tokens that anyone reading the metrics would see.")
+	configStringKinds   = flag.String("strings.parse", "", "Comma-separated kinds of string expvars to convert into samples instead of dropping them: number, duration, timestamp, size, bool, info.")
+
+	configDetectCounters    = flag.Bool("counters.detect", false, "Classify metrics that keep increasing across scrapes as counters and append _total.")
+	configCounterMinScrapes = flag.Int("counters.min-scrapes", 3, "Number of consecutive non-decreasing scrapes required to classify a metric as counter.")
+
+	configScript = flag.String("script.file", "", "Path to a Starlark script defining metrics(expvars), which translates the expvars that rules can't express into metric families (optional).")
 )
 
 func main() {
 	flag.Parse()
+	if err := setFlagsFromEnv(flag.CommandLine); err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		os.Exit(2)
+	}
+	if *configVersion {
+		fmt.Println(version.Print(programName))
+		return
+	}
+	logger, err := newLogger(os.Stderr, *configLogLevel, *configLogFormat)
+	if err == nil && isService() {
+		// Services have no stderr to log to.
+		logger, err = newServiceLogger(*configLogLevel, *configLogFormat)
+	}
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		os.Exit(2)
+	}
+	slog.SetDefault(logger)
+
+	// Scrapers that don't announce support for UTF-8 names get underscores,
+	// which looks the most like names sanitized by the proxy itself.
+	model.NameEscapingScheme = model.UnderscoreEscaping
+
+	if *configShardTotal < 1 || *configShardIndex < 0 || *configShardIndex >= *configShardTotal {
+		fatal("invalid -shard.index or -shard.total", "index", *configShardIndex, "total", *configShardTotal)
+	}
+	privateNetworksDenied = *configDenyPrivate
+	cfg, err := loadConfig()
+	if err != nil {
+		fatal("failed to load config", "err", err)
+	}
+
+	allowedClients, err := ParseClientAllowlist(*configAllowedClients)
+	if err != nil {
+		fatal("invalid -web.allowed-clients", "err", err)
+	}
+
+	allowedTargets, err := ParseTargetAllowlist(*configAllowedTargets)
+	if err != nil {
+		fatal("invalid -targets.allow", "err", err)
+	}
+
+	stringKinds, err := expvarcollector.ParseStringKinds(*configStringKinds)
+	if err != nil {
+		fatal("invalid -strings.parse", "err", err)
+	}
+
+	if err := expvarcollector.CheckNonASCIIPolicy(*configNonASCII); err != nil {
+		fatal("invalid -names.non-ascii", "err", err)
+	}
+	if err := expvarcollector.CheckCollisionMode(*configCollisions); err != nil {
+		fatal("invalid -names.collisions", "err", err)
+	}
+	if err := expvarcollector.CheckArrayMode(*configArrayMode); err != nil {
+		fatal("invalid -arrays", "err", err)
+	}
+	if err := expvarcollector.CheckNonFinitePolicy(*configNonFinite); err != nil {
+		fatal("invalid -values.non-finite", "err", err)
+	}
+
+	if *configWeb != "" {
+		if err := web.Validate(*configWeb); err != nil {
+			fatal("invalid -web.config.file", "err", err)
+		}
+	}
+
+	if *configPrefix != "" && !metricPrefixRE.MatchString(*configPrefix) {
+		fatal("invalid -metric.prefix", "prefix", *configPrefix)
+	}
 
-	log.Printf("listen to %s in Proxy mode, timeout: %v", *configAddr, *configTimeout)
 	proxy := &Proxy{
 		Client: http.Client{
-			Timeout: *configTimeout,
+			Timeout:       *configTimeout,
+			CheckRedirect: checkRedirect,
+		},
+		AllowedTargets:   allowedTargets,
+		Retries:          *configRetries,
+		RetryBackoff:     *configRetryBackoff,
+		RetryJitter:      *configRetryJitter,
+		TimeoutOffset:    *configTimeoutOffset,
+		Prefix:           *configPrefix,
+		NativeHistograms: *configNative,
+		Decimals:         *configDecimals,
+		Options: expvarcollector.Options{
+			MaxBodySize: *configMaxBody,
+			MaxDepth:    *configMaxDepth,
+			MaxSamples:  *configMaxSamples,
+			GoMemstats:  *configGoMemstats,
+			BySize:      *configBySize,
+			CmdlineInfo: *configCmdlineInfo,
+			StringKinds: stringKinds,
+			ArrayMode:   *configArrayMode,
+			NonASCII:    *configNonASCII,
+			SnakeCase:   *configSnakeCase,
+			Collisions:  *configCollisions,
+			NonFinite:   *configNonFinite,
 		},
 	}
-	if err := http.ListenAndServe(*configAddr, proxy); err != nil && !errors.Is(err, http.ErrServerClosed) {
-		log.Fatal("ListenAndServe:", err)
+	proxy.Cache = &ScrapeCache{TTL: *configCacheTTL, Grace: *configStaleGrace}
+	tlsConfig := TLSConfig{CAFile: *configCAFile, InsecureSkipVerify: *configInsecureSkipVerify}
+	if tlsConfig != (TLSConfig{}) || *configDenyPrivate {
+		transport, err := newTransport(&tlsConfig)
+		if err != nil {
+			fatal("invalid -tls.ca-file", "err", err)
+		}
+		proxy.Client.Transport = transport
+	}
+	if tlsConfig.InsecureSkipVerify {
+		slog.Warn("certificates of targets are NOT verified because of -tls.insecure-skip-verify, connections to https:// targets are insecure")
+	}
+	if *configMaxConcurrent > 0 {
+		proxy.Limiter = NewScrapeLimiter(*configMaxConcurrent, *configMaxQueued)
+	}
+	if *configNameCacheSize > 0 {
+		proxy.Names = &expvarcollector.NameCache{Size: *configNameCacheSize}
+	}
+	if *configGoMemstats {
+		proxy.GCPauses = &expvarcollector.GCPauseTracker{}
+	}
+	if *configScript != "" {
+		proxy.Script, err = expvarcollector.LoadScript(*configScript)
+		if err != nil {
+			fatal("invalid -script.file", "err", err)
+		}
+	}
+	if *configDetectCounters {
+		proxy.Counters = &CounterDetector{MinScrapes: *configCounterMinScrapes}
+	}
+	proxy.SetConfig(cfg)
+
+	proxy.Scheduler = &Scheduler{Proxy: proxy, Interval: *configInterval}
+	// Background scrapes stop once the proxy is asked to exit, by signals or
+	// the Windows service manager.
+	ctx, stop := signal.NotifyContext(context.Background(), syscall.SIGTERM, os.Interrupt)
+	defer stop()
+	ctx, serviceDone := serviceContext(ctx)
+	defer serviceDone()
+	proxy.Scheduler.Start(ctx, cfg.Targets)
+
+	landing, err := newLandingPage(*configFile != "")
+	if err != nil {
+		fatal("error creating landing page", "err", err)
+	}
+	mux := http.NewServeMux()
+	mux.Handle("/{$}", landing)
+	mux.Handle("/probe", &Probe{Proxy: proxy, DefaultPath: *configProbe})
+	mux.HandleFunc("/-/healthy", serveHealthy)
+	mux.Handle("/debug/vars", expvar.Handler())
+	mux.Handle("/-/ready", &Readiness{Scheduler: proxy.Scheduler})
+	if *configTracingEndpoint != "" {
+		tp, err := newTracerProvider(context.Background(), *configTracingEndpoint, *configTracingRatio)
+		if err != nil {
+			fatal("invalid -tracing.endpoint", "err", err)
+		}
+		// Spans still buffered are exported when the proxy exits.
+		defer tp.Shutdown(context.Background())
+		proxy.TracerProvider = tp
+	}
+	if *configTelemetry != "" {
+		proxy.Telemetry = NewTelemetry()
+		mux.Handle(*configTelemetry, proxy.Telemetry.Handler())
+	}
+	if *configFile != "" {
+		// Shards always serve their targets merged and labeled, even if they
+		// got one or none, so that all replicas look alike.
+		mux.Handle("/metrics", &Exporter{Proxy: proxy, SingleUnlabeled: *configSingle && *configShardTotal == 1})
+
+		reloader := &Reloader{Proxy: proxy, Load: loadConfig, Context: ctx}
+		go reloader.WatchSIGHUP(ctx)
+		if *configLifecycle {
+			mux.Handle("/-/reload", reloader)
+		}
+	}
+
+	if *configPprof {
+		go servePprof(*configPprofAddr)
+	}
+
+	var accessLog *AccessLog
+	if *configAccessLog != "" {
+		if accessLog, err = OpenAccessLog(*configAccessLog, *configAccessLogFormat); err != nil {
+			fatal("invalid -web.access-log", "err", err)
+		}
+	}
+
+	var limiter *RateLimiter
+	if *configRateLimit > 0 || *configClientRateLimit > 0 {
+		limiter = &RateLimiter{Global: *configRateLimit, PerClient: *configClientRateLimit, Burst: *configRateBurst}
+	}
+
+	slog.Info("starting proxy", "address", *configAddr, "timeout", *configTimeout, "version", version.Version)
+	handler := http.HandlerFunc(func(wr http.ResponseWriter, req *http.Request) {
+		slog.Debug("request", "client", req.RemoteAddr, "method", req.Method, "url", req.URL.Redacted())
+		start := time.Now()
+		rec := &statusRecorder{ResponseWriter: wr, code: http.StatusOK}
+		defer func() {
+			proxy.Telemetry.Request(route(mux, req), rec.code)
+			accessLog.Log(req, rec.code, rec.bytes, start)
+		}()
+		wr = rec
+
+		// Health checks come from orchestrators, which mustn't be limited
+		// like scrapers.
+		if isHealthCheck(req) {
+			mux.ServeHTTP(wr, req)
+			return
+		}
+		if !allowedClients.Allowed(req.RemoteAddr) {
+			proxy.sendError(wr, http.StatusForbidden, fmt.Errorf("client %s is not allowed", req.RemoteAddr))
+			return
+		}
+		if err := limiter.Allow(req.RemoteAddr); err != nil {
+			wr.Header().Set("Retry-After", "1")
+			proxy.sendError(wr, http.StatusTooManyRequests, err)
+			return
+		}
+
+		// Proxy requests carry the absolute target URL in the request line,
+		// everything else is addressed to the exporter itself.
+		if req.URL.IsAbs() {
+			proxy.ServeHTTP(wr, req)
+		} else {
+			mux.ServeHTTP(wr, req)
+		}
+	})
+	server := &http.Server{Handler: proxy.tracedHandler(handler, mux)}
+	webFlags := &web.FlagConfig{WebConfigFile: configWeb}
+	listener, err := net.Listen("tcp", *configAddr)
+	if err != nil {
+		fatal("failed to listen", "address", *configAddr, "err", err)
+	}
+	serveErr := make(chan error, 1)
+	go func() {
+		serveErr <- web.Serve(listener, server, webFlags, slog.Default())
+	}()
+	// Under systemd, units depending on the proxy start once it accepts
+	// connections.
+	notifySystemd(daemon.SdNotifyReady)
+	go watchSystemd(ctx)
+
+	select {
+	case err := <-serveErr:
+		if !errors.Is(err, http.ErrServerClosed) {
+			fatal("failed to serve", "err", err)
+		}
+	case <-ctx.Done():
+		stop()
+		notifySystemd(daemon.SdNotifyStopping)
+		slog.Info("shutting down, waiting for requests in flight", "timeout", *configDrain)
+		drainCtx, cancel := context.WithTimeout(context.Background(), *configDrain)
+		defer cancel()
+		if err := server.Shutdown(drainCtx); err != nil {
+			fatal("failed to finish requests in flight", "err", err)
+		}
+		slog.Info("shut down")
 	}
 }
 
 type Proxy struct {
 	Client http.Client
+
+	// AllowedTargets restricts the targets given by clients if not empty.
+	AllowedTargets TargetAllowlist
+
+	// Retries is the number of retries of scrapes failing with connection
+	// errors or 5xx responses, waiting RetryBackoff changed randomly by the
+	// fraction RetryJitter and doubled for each further retry.
+	Retries      int
+	RetryBackoff time.Duration
+	RetryJitter  float64
+
+	// TimeoutOffset is subtracted from the scrape timeout sent by Prometheus
+	// to get the timeout of target requests.
+	TimeoutOffset time.Duration
+
+	// Prefix is prepended to all metric names, unless overridden by targets.
+	Prefix string
+
+	// Cache shares scrapes of the same target if non-nil.
+	Cache *ScrapeCache
+
+	// Scheduler scrapes configured targets in the background if non-nil.
+	Scheduler *Scheduler
+
+	// Limiter limits simultaneous upstream scrapes if non-nil.
+	Limiter *ScrapeLimiter
+
+	// Telemetry records the metrics of the proxy itself if non-nil.
+	Telemetry *Telemetry
+
+	// TracerProvider traces requests to the proxy and to targets if non-nil.
+	TracerProvider trace.TracerProvider
+
+	// Counters is used to detect counters if non-nil.
+	Counters *CounterDetector
+
+	// NativeHistograms adds native buckets to synthesized histograms in the
+	// protobuf format.
+	NativeHistograms bool
+
+	// Decimals rounds values to fixed decimal places if not negative.
+	Decimals int
+
+	// Options configure the flattening of expvars. Their rules are taken
+	// from the current config.
+	expvarcollector.Options
+
+	config atomic.Pointer[Config]
 }
 
-func (p *Proxy) ServeHTTP(wr http.ResponseWriter, req *http.Request) {
-	log.Println(req.RemoteAddr, " ", req.Method, " ", req.URL)
+// Config returns the current config.
+func (p *Proxy) Config() *Config {
+	return p.config.Load()
+}
 
-	metricMap, cerr := p.collect(req.URL)
-	if cerr != nil {
-		log.Println("failed to gather metrics: ", cerr)
-		if errors.Is(cerr, ErrTargetInaccessible) {
-			p.sendError(wr, http.StatusGatewayTimeout, cerr)
-		} else {
-			p.sendError(wr, http.StatusBadGateway, cerr)
+// SetConfig replaces the config. Cached names and scrapes are dropped, as
+// they depend on the config. Requests in flight keep the previous one.
+// Targets that didn't change keep the size hint of their previous scrape.
+func (p *Proxy) SetConfig(cfg *Config) {
+	if previous := p.Config(); previous != nil {
+		for _, t := range cfg.Targets {
+			if old := previous.Target(t.Name); t.unchanged(old) {
+				t.lastSamples.Store(old.lastSamples.Load())
+			}
 		}
+	}
+	p.config.Store(cfg)
+	p.Names.Reset()
+	p.Cache.Reset()
+}
+
+func (p *Proxy) ServeHTTP(wr http.ResponseWriter, req *http.Request) {
+	u := *req.URL
+	if u.Scheme != "http" && u.Scheme != "https" {
+		p.sendError(wr, http.StatusBadRequest, fmt.Errorf("unsupported scheme %q", u.Scheme))
+		return
+	}
+	if !p.AllowedTargets.Allowed(&u) {
+		p.sendError(wr, http.StatusForbidden, fmt.Errorf("target %s is not allowed", u.Host))
+		return
+	}
+	query := u.Query()
+	labels, err := extractLabelParams(query)
+	if err != nil {
+		p.sendError(wr, http.StatusBadRequest, err)
 		return
 	}
+	if len(labels) > 0 {
+		u.RawQuery = query.Encode()
+	}
+	p.serveTarget(wr, req, &TargetConfig{parsedURL: &u, labels: labels}, 0)
+}
 
-	metricNames := maps.Keys(metricMap)
-	sort.Strings(metricNames)
+// serveTarget scrapes the target and sends the result in Prometheus format.
+// timeout shortens the timeout of the target if positive.
+func (p *Proxy) serveTarget(wr http.ResponseWriter, req *http.Request, target *TargetConfig, timeout time.Duration) {
+	families, err := p.targetFamilies(req, target, timeout, target.labels)
+	if err != nil {
+		p.sendError(wr, http.StatusServiceUnavailable, err)
+		return
+	}
+	families = append(families, buildInfoFamily())
+	if err := sendFamilies(wr, req, families, p.NativeHistograms); err != nil {
+		slog.Warn("failed to send metrics", "target", target.parsedURL.Redacted(), "err", err)
+	}
+}
 
-	sb := &strings.Builder{}
-	for _, name := range metricNames {
-		sb.WriteString(fmt.Sprintf("%s %f\n", name, metricMap[name]))
+// targetFamilies scrapes the target for the request, or takes its latest or
+// cached scrape, and returns its families with the labels, including those
+// describing the scrape. Failed scrapes are reported by expvar_up, so it
+// only fails if no scrape slot is free, when it's the proxy that is
+// overloaded rather than the target.
+func (p *Proxy) targetFamilies(req *http.Request, target *TargetConfig, timeout time.Duration, labels []Label) ([]metricFamily, error) {
+	key := target.key()
+	var result scrapeResult
+	var cerr error
+	if p.Scheduler.Scheduled(target) {
+		result, cerr = p.Scheduler.Latest(req.Context(), target)
+	} else {
+		// The scrape may be shared with requests that wait longer than this
+		// one, so it gets the larger of the timeouts of the request and the
+		// target, while this request only waits for its own.
+		ctx := req.Context()
+		wait := p.timeout(req, target, timeout)
+		if wait > 0 {
+			var cancel context.CancelFunc
+			ctx, cancel = context.WithTimeout(ctx, wait)
+			defer cancel()
+		}
+		scrapeTimeout := p.targetTimeout(target, timeout)
+		if scrapeTimeout > 0 && wait > scrapeTimeout {
+			scrapeTimeout = wait
+		}
+		result, cerr = p.Cache.Get(ctx, key, func(ctx context.Context) (scrapeResult, error) {
+			if scrapeTimeout > 0 {
+				var cancel context.CancelFunc
+				ctx, cancel = context.WithTimeout(ctx, scrapeTimeout)
+				defer cancel()
+			}
+			return p.scrape(ctx, target, scrapeTimeout)
+		})
+	}
+	shared, counters := result.samples, result.counters
+	stale := false
+	if cerr != nil {
+		slog.Warn("failed to scrape target", "target", target.parsedURL.Redacted(), "duration", result.duration, "err", cerr)
+		if errors.Is(cerr, errNoScrapeSlot) {
+			return nil, cerr
+		}
+		var last scrapeResult
+		if last, stale = p.Cache.Stale(key); stale {
+			shared, counters = last.samples, last.counters
+		}
+	} else {
+		slog.Debug("scraped target", "target", target.parsedURL.Redacted(), "duration", result.duration, "samples", len(shared))
 	}
 
-	wr.WriteHeader(http.StatusOK)
-	_, werr := wr.Write([]byte(sb.String()))
-	if werr != nil {
-		log.Println("failed to send metrics: ", werr)
+	// Samples may be shared with other requests, so they're copied before
+	// adding the labels of this one.
+	samples := addTargetLabels(append([]sample(nil), shared...), labels)
+	families := p.families(target, samples, counters)
+	families = append(families, scrapeFamilies(labels, cerr == nil, result.duration, len(shared))...)
+	if p.Cache.Grace > 0 {
+		families = append(families, staleFamilies(labels, stale)...)
 	}
+	return families, nil
 }
 
-func (p *Proxy) sendError(wr http.ResponseWriter, statusCode int, err error) {
-	wr.WriteHeader(statusCode)
-	_, herr := wr.Write([]byte(err.Error()))
-	if herr != nil {
-		log.Println("failed to send error: ", herr)
-	}
+// scrapeResult is the outcome of a scrape of a target.
+type scrapeResult struct {
+	samples  []sample
+	counters map[string]bool // names of metrics detected as counters
+	duration time.Duration
 }
 
-var ErrTargetInaccessible = errors.New("inaccessible target")
+// scrape collects the samples of the target once a scrape slot is free.
+func (p *Proxy) scrape(ctx context.Context, target *TargetConfig, timeout time.Duration) (_ scrapeResult, err error) {
+	ctx, span := p.tracer().Start(ctx, "scrape", trace.WithAttributes(
+		semconv.URLFull(target.parsedURL.Redacted()),
+		attribute.String("expvar.target", target.Name),
+	))
+	defer func() { endSpan(span, err) }()
 
-func (p *Proxy) collect(target *url.URL) (map[string]float64, error) {
-	resp, err := p.Client.Get(target.String())
-	if err != nil {
-		return nil, fmt.Errorf("%w; error scraping %q: %w", ErrTargetInaccessible, target, err)
+	if err := p.Limiter.Acquire(ctx); err != nil {
+		return scrapeResult{}, fmt.Errorf("%w: %w", errNoScrapeSlot, err)
 	}
-
-	body, err := io.ReadAll(resp.Body)
+	defer p.Limiter.Release()
+	start := time.Now()
+	samples, err := p.collect(ctx, p.client(target, timeout), target)
+	result := scrapeResult{duration: time.Since(start)}
 	if err != nil {
-		return nil, fmt.Errorf("%w; error reading body of %q: %w", ErrTargetInaccessible, target, err)
+		return result, err
 	}
+	if p.Decimals >= 0 {
+		roundValues(samples, p.Decimals)
+	}
+	result.samples = samples
+	// Counters are detected once per scrape, however often its result is
+	// served from the cache or the scheduler.
+	if p.Counters != nil {
+		result.counters = p.Counters.Observe(target.key(), samples)
+	}
+	return result, nil
+}
 
-	// Replace "\xNN" with "?" because the default parser doesn't handle them
-	// well.
-	re := regexp.MustCompile(`\\x..`)
-	body = re.ReplaceAllFunc(body, func(s []byte) []byte {
-		return []byte("?")
-	})
-
-	var vs map[string]interface{}
-	err = json.Unmarshal(body, &vs)
-	if err != nil {
-		return nil, fmt.Errorf("error unmarshalling JSON from %q: %v", target, err)
+// timeout returns the timeout of scraping the target for the request: the
+// timeout of the target or the client, or the shorter override, limited by
+// the scrape timeout sent by Prometheus less TimeoutOffset.
+func (p *Proxy) timeout(req *http.Request, target *TargetConfig, override time.Duration) time.Duration {
+	timeout := p.targetTimeout(target, override)
+	seconds, err := strconv.ParseFloat(req.Header.Get("X-Prometheus-Scrape-Timeout-Seconds"), 64)
+	if err != nil || seconds <= 0 {
+		return timeout
+	}
+	scrapeTimeout := time.Duration(seconds*float64(time.Second)) - p.TimeoutOffset
+	if scrapeTimeout <= 0 {
+		// Better to try than to fail for sure.
+		scrapeTimeout = time.Duration(seconds * float64(time.Second))
 	}
+	if timeout <= 0 || scrapeTimeout < timeout {
+		return scrapeTimeout
+	}
+	return timeout
+}
 
-	mm := make(map[string]float64, 1000)
-	for k, v := range vs {
-		collectMetrics(mm, k, v)
+// targetTimeout returns the timeout of the target or the client, or the
+// override if positive and shorter, so that clients can't hold scrape slots
+// and connections longer than configured.
+func (p *Proxy) targetTimeout(target *TargetConfig, override time.Duration) time.Duration {
+	timeout := p.Client.Timeout
+	if target.Timeout > 0 {
+		timeout = target.Timeout
 	}
-	return mm, nil
+	if override > 0 && (timeout <= 0 || override < timeout) {
+		return override
+	}
+	return timeout
 }
 
-func collectMetrics(mm map[string]float64, k string, v interface{}) {
-	name := sanitizeMetricName(k)
+// client returns the HTTP client to scrape the target with the timeout.
+// Redirects of targets given by clients must stay within AllowedTargets.
+func (p *Proxy) client(target *TargetConfig, timeout time.Duration) *http.Client {
+	restricted := target.Name == "" && len(p.AllowedTargets) > 0
+	if timeout == p.Client.Timeout && target.transport == nil && !restricted && p.TracerProvider == nil {
+		return &p.Client
+	}
+	c := p.Client
+	c.Timeout = timeout
+	if target.transport != nil {
+		c.Transport = target.transport
+	}
+	c.Transport = p.tracedTransport(c.Transport)
+	if restricted {
+		c.CheckRedirect = p.AllowedTargets.CheckRedirect
+	}
+	return &c
+}
 
-	switch v := v.(type) {
-	case float64:
-		mm[name] = v
-	case bool:
-		mm[name] = valToFloat(v)
-	case map[string]interface{}:
-		for lk, lv := range v {
-			collectMetrics(mm, k+"_"+lk, lv)
-		}
-	case string:
-		// Not supported by Prometheus.
-		return
-	case []interface{}:
-		// Not supported by Prometheus.
-		return
-	default:
-		fmt.Printf("Not supported unknown type: %q %#v\n", name, v)
-		return
+func (p *Proxy) sendError(wr http.ResponseWriter, statusCode int, err error) {
+	wr.WriteHeader(statusCode)
+	_, herr := wr.Write([]byte(err.Error()))
+	if herr != nil {
+		slog.Warn("failed to send error", "err", herr)
 	}
 }
 
-func valToFloat(v interface{}) float64 {
-	switch v := v.(type) {
-	case float64:
-		return v
-	case bool:
-		if v {
-			return 1.0
+// loadConfig loads the config file if given, and adds the settings of flags
+// to it.
+func loadConfig() (*Config, error) {
+	cfg := &Config{}
+	if *configFile != "" {
+		var err error
+		if cfg, err = LoadConfig(*configFile); err != nil {
+			return nil, err
+		}
+		slog.Info("loaded config", "file", *configFile, "targets", len(cfg.Targets))
+	} else if err := cfg.validate(); err != nil {
+		return nil, err
+	}
+	if *configShardTotal > 1 {
+		cfg.Targets = shardTargets(cfg.Targets, *configShardIndex, *configShardTotal)
+		slog.Info("sharded targets", "shard", *configShardIndex, "total", *configShardTotal, "targets", len(cfg.Targets))
+	}
+	// The flags apply to modules as well.
+	rules := []*expvarcollector.Rules{&cfg.Rules}
+	for _, m := range cfg.Modules {
+		rules = append(rules, &m.Rules)
+	}
+	for _, r := range rules {
+		r.StripPrefixes = append(r.StripPrefixes, nonEmpty(*configStripPrefix)...)
+		if err := r.AddFilters(nonEmpty(*configInclude), nonEmpty(*configExclude)); err != nil {
+			return nil, fmt.Errorf("invalid metric filter: %w", err)
 		}
-		return 0.0
 	}
-	panic(fmt.Sprintf("unexpected value type: %#v", v))
+	for _, t := range cfg.Targets {
+		if t.TLS != nil && t.TLS.InsecureSkipVerify {
+			slog.Warn("certificates of target are NOT verified because of insecure_skip_verify, connections to it are insecure", "target", t.Name)
+		}
+	}
+	return cfg, nil
 }
 
-func sanitizeMetricName(n string) string {
-	// Prometheus metric names must match the regex
-	// `[a-zA-Z_:][a-zA-Z0-9_:]*`.
-	// https://prometheus.io/docs/concepts/data_model/#metric-names-and-labels
-	//
-	// This function replaces all non-matching ASCII characters with
-	// underscores.
-	//
-	// In particular, it is common that expvar names contain `/` or `-`, which
-	// we replace with `_` so they end up resembling more Prometheus-ideomatic
-	// names.
-	//
-	// Non-ascii characters are not supported, and will panic as so to force
-	// users to handle them explicitly.  There is no good way to handle all of
-	// them automatically, as they can't be all reasonably mapped to ascii. In
-	// the future, we may handle _some_ of them automatically when possible.
-	// But for now, forcing the users to be explicit is the safest option, and
-	// also ensures forwards compatibility.
-	return strings.Map(func(r rune) rune {
-		if r >= 'a' && r <= 'z' {
-			return r
-		}
-		if r >= 'A' && r <= 'Z' {
-			return r
-		}
-		if r >= '0' && r <= '9' {
-			return r
-		}
-		if r == '_' || r == ':' {
-			return r
-		}
-		if r > unicode.MaxASCII {
-			panic(fmt.Sprintf(
-				"non-ascii character %q is unsupported, please configure the metric %q explicitly",
-				r, n))
-		}
-		return '_'
-	}, n)
+// nonEmpty returns a list of s, or nil if s is empty.
+func nonEmpty(s string) []string {
+	if s == "" {
+		return nil
+	}
+	return []string{s}
 }
@@ -0,0 +1,41 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+// newTestProxy returns a proxy with the config, as loaded from YAML, and the
+// defaults of the flags that matter for tests.
+func newTestProxy(t *testing.T, config string) *Proxy {
+	t.Helper()
+	path := filepath.Join(t.TempDir(), "config.yml")
+	if err := os.WriteFile(path, []byte(config), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	cfg, err := LoadConfig(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	p := &Proxy{Decimals: -1}
+	p.SetConfig(cfg)
+	return p
+}
+
+// testRequest returns a request to the proxy, as by Prometheus.
+func testRequest() *http.Request {
+	return httptest.NewRequest(http.MethodGet, "/metrics", nil)
+}
+
+// findFamily returns the family of the name, or nil.
+func findFamily(families []metricFamily, name string) *metricFamily {
+	for i := range families {
+		if families[i].Name == name {
+			return &families[i]
+		}
+	}
+	return nil
+}
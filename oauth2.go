@@ -0,0 +1,108 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"net/url"
+	"sync"
+	"time"
+
+	"golang.org/x/oauth2"
+	"golang.org/x/oauth2/clientcredentials"
+	"golang.org/x/sync/singleflight"
+)
+
+// tokenExpiryDelta is how long before their expiry OAuth2 tokens are
+// refreshed, so that they don't expire while a scrape is on the way.
+const tokenExpiryDelta = 10 * time.Second
+
+// OAuth2Config configures the OAuth2 client credentials flow to get access
+// tokens for targets, like the oauth2 block of Prometheus scrape configs.
+type OAuth2Config struct {
+	ClientID string `yaml:"client_id"`
+
+	// ClientSecret or ClientSecretFile, the path to a file with the secret.
+	ClientSecret     string `yaml:"client_secret"`
+	ClientSecretFile string `yaml:"client_secret_file"`
+
+	TokenURL       string            `yaml:"token_url"`
+	Scopes         []string          `yaml:"scopes"`
+	EndpointParams map[string]string `yaml:"endpoint_params"`
+
+	mu      sync.Mutex
+	token   *oauth2.Token
+	fetches singleflight.Group
+}
+
+func (oc *OAuth2Config) validate() error {
+	if oc.ClientID == "" {
+		return fmt.Errorf("missing client_id")
+	}
+	if oc.ClientSecret != "" && oc.ClientSecretFile != "" {
+		return fmt.Errorf("client_secret and client_secret_file are mutually exclusive")
+	}
+	u, err := url.Parse(oc.TokenURL)
+	if err != nil {
+		return fmt.Errorf("invalid token_url: %w", err)
+	}
+	if !u.IsAbs() || u.Host == "" {
+		return fmt.Errorf("token_url must be absolute, got %q", oc.TokenURL)
+	}
+	return nil
+}
+
+// Token returns the current access token, fetching a new one with the client
+// if there is none yet or it's about to expire. Concurrent callers share one
+// fetch, which isn't canceled with their ctx, but they stop waiting for it
+// when their ctx is done.
+func (oc *OAuth2Config) Token(ctx context.Context, client *http.Client) (string, error) {
+	oc.mu.Lock()
+	token := oc.token
+	oc.mu.Unlock()
+	if token != nil && (token.Expiry.IsZero() || time.Now().Add(tokenExpiryDelta).Before(token.Expiry)) {
+		return token.AccessToken, nil
+	}
+
+	fetched := oc.fetches.DoChan("", func() (interface{}, error) {
+		token, err := oc.fetch(context.WithoutCancel(ctx), client)
+		if err != nil {
+			return nil, err
+		}
+		oc.mu.Lock()
+		oc.token = token
+		oc.mu.Unlock()
+		return token, nil
+	})
+	select {
+	case r := <-fetched:
+		if r.Err != nil {
+			return "", fmt.Errorf("error fetching OAuth2 token from %q: %w", oc.TokenURL, r.Err)
+		}
+		return r.Val.(*oauth2.Token).AccessToken, nil
+	case <-ctx.Done():
+		return "", fmt.Errorf("error fetching OAuth2 token from %q: %w", oc.TokenURL, ctx.Err())
+	}
+}
+
+// fetch requests a new access token from the token URL with the client,
+// whose timeout limits the request.
+func (oc *OAuth2Config) fetch(ctx context.Context, client *http.Client) (*oauth2.Token, error) {
+	secret, err := readSecret(oc.ClientSecret, oc.ClientSecretFile)
+	if err != nil {
+		return nil, err
+	}
+	params := make(url.Values, len(oc.EndpointParams))
+	for k, v := range oc.EndpointParams {
+		params.Set(k, v)
+	}
+	cc := &clientcredentials.Config{
+		ClientID:       oc.ClientID,
+		ClientSecret:   secret,
+		TokenURL:       oc.TokenURL,
+		Scopes:         oc.Scopes,
+		EndpointParams: params,
+		AuthStyle:      oauth2.AuthStyleInHeader,
+	}
+	return cc.Token(context.WithValue(ctx, oauth2.HTTPClient, client))
+}
@@ -0,0 +1,88 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func TestOAuth2Token(t *testing.T) {
+	var fetches atomic.Int64
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		id, secret, _ := req.BasicAuth()
+		if id != "prometheus" || secret != "s3cret" {
+			http.Error(w, "bad client", http.StatusUnauthorized)
+			return
+		}
+		if req.FormValue("grant_type") != "client_credentials" || req.FormValue("scope") != "metrics read" || req.FormValue("audience") != "myapp" {
+			http.Error(w, "bad form "+req.Form.Encode(), http.StatusBadRequest)
+			return
+		}
+		n := fetches.Add(1)
+		time.Sleep(50 * time.Millisecond)
+		w.Header().Set("Content-Type", "application/json")
+		fmt.Fprintf(w, `{"access_token": "token-%d", "token_type": "Bearer", "expires_in": 3600}`, n)
+	}))
+	defer server.Close()
+
+	oc := &OAuth2Config{
+		ClientID:       "prometheus",
+		ClientSecret:   "s3cret",
+		TokenURL:       server.URL,
+		Scopes:         []string{"metrics", "read"},
+		EndpointParams: map[string]string{"audience": "myapp"},
+	}
+	if err := oc.validate(); err != nil {
+		t.Fatal(err)
+	}
+
+	var wg sync.WaitGroup
+	for i := 0; i < 5; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			token, err := oc.Token(context.Background(), server.Client())
+			if err != nil || token != "token-1" {
+				t.Errorf("got token %q, %v; want token-1", token, err)
+			}
+		}()
+	}
+	wg.Wait()
+	if token, err := oc.Token(context.Background(), server.Client()); err != nil || token != "token-1" {
+		t.Errorf("got cached token %q, %v; want token-1", token, err)
+	}
+	if n := fetches.Load(); n != 1 {
+		t.Errorf("got %d fetches, want 1", n)
+	}
+}
+
+func TestOAuth2TokenDoesNotBlockPastDeadline(t *testing.T) {
+	release := make(chan struct{})
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		<-release
+		w.Header().Set("Content-Type", "application/json")
+		fmt.Fprint(w, `{"access_token": "late", "token_type": "Bearer"}`)
+	}))
+	defer server.Close()
+	defer close(release)
+
+	oc := &OAuth2Config{ClientID: "prometheus", TokenURL: server.URL}
+	go oc.Token(context.Background(), server.Client())
+
+	ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer cancel()
+	start := time.Now()
+	_, err := oc.Token(ctx, server.Client())
+	if !errors.Is(err, context.DeadlineExceeded) {
+		t.Errorf("got error %v, want deadline exceeded", err)
+	}
+	if d := time.Since(start); d > time.Second {
+		t.Errorf("waited %v for the token", d)
+	}
+}
@@ -0,0 +1,24 @@
+package main
+
+import (
+	"log/slog"
+	"net/http"
+	"net/http/pprof"
+)
+
+// servePprof serves the profiles of net/http/pprof at /debug/pprof/ on addr,
+// which should only be reachable by admins, since profiles reveal internals
+// and are expensive.
+func servePprof(addr string) {
+	mux := http.NewServeMux()
+	mux.HandleFunc("/debug/pprof/", pprof.Index)
+	mux.HandleFunc("/debug/pprof/cmdline", pprof.Cmdline)
+	mux.HandleFunc("/debug/pprof/profile", pprof.Profile)
+	mux.HandleFunc("/debug/pprof/symbol", pprof.Symbol)
+	mux.HandleFunc("/debug/pprof/trace", pprof.Trace)
+
+	slog.Info("serving pprof", "address", addr)
+	if err := http.ListenAndServe(addr, mux); err != nil {
+		slog.Error("failed to serve pprof", "address", addr, "err", err)
+	}
+}
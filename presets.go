@@ -0,0 +1,46 @@
+package main
+
+import (
+	"bytes"
+	"embed"
+	"fmt"
+	"path"
+	"strings"
+
+	"gopkg.in/yaml.v3"
+)
+
+// presetFiles are the built-in modules, named by their files.
+//
+//go:embed presets/*.yml
+var presetFiles embed.FS
+
+// addPresets adds the built-in modules that aren't defined by the config, so
+// that modules of the config can replace them.
+func (cfg *Config) addPresets() error {
+	files, err := presetFiles.ReadDir("presets")
+	if err != nil {
+		return err
+	}
+	for _, f := range files {
+		name := strings.TrimSuffix(f.Name(), path.Ext(f.Name()))
+		if _, ok := cfg.Modules[name]; ok {
+			continue
+		}
+		content, err := presetFiles.ReadFile("presets/" + f.Name())
+		if err != nil {
+			return err
+		}
+		dec := yaml.NewDecoder(bytes.NewReader(content))
+		dec.KnownFields(true)
+		m := &ModuleConfig{}
+		if err := dec.Decode(m); err != nil {
+			return fmt.Errorf("error parsing preset %q: %w", name, err)
+		}
+		if cfg.Modules == nil {
+			cfg.Modules = make(map[string]*ModuleConfig)
+		}
+		cfg.Modules[name] = m
+	}
+	return nil
+}
@@ -0,0 +1,105 @@
+package main
+
+import (
+	"fmt"
+	"net"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Probe serves "/probe?target=host:port" in the style of blackbox_exporter,
+// so that targets can be set via Prometheus relabeling.
+type Probe struct {
+	Proxy *Proxy
+
+	// DefaultPath is used for targets given without a path.
+	DefaultPath string
+}
+
+func (p *Probe) ServeHTTP(wr http.ResponseWriter, req *http.Request) {
+	query := req.URL.Query()
+	tc := &TargetConfig{Module: query.Get("module")}
+	defaultPath := p.DefaultPath
+	if tc.Module != "" {
+		if tc.module = p.Proxy.Config().Modules[tc.Module]; tc.module == nil {
+			p.Proxy.sendError(wr, http.StatusBadRequest, fmt.Errorf("unknown module %q", tc.Module))
+			return
+		}
+		if tc.module.Path != "" {
+			defaultPath = tc.module.Path
+		}
+	}
+	u, err := p.parseTarget(query.Get("target"), defaultPath)
+	if err != nil {
+		p.Proxy.sendError(wr, http.StatusBadRequest, err)
+		return
+	}
+	if !p.Proxy.AllowedTargets.Allowed(u) {
+		p.Proxy.sendError(wr, http.StatusForbidden, fmt.Errorf("target %s is not allowed", u.Host))
+		return
+	}
+	labels, err := extractLabelParams(query)
+	if err != nil {
+		p.Proxy.sendError(wr, http.StatusBadRequest, err)
+		return
+	}
+	timeout, err := parseTimeoutParam(query.Get("timeout"))
+	if err != nil {
+		p.Proxy.sendError(wr, http.StatusBadRequest, err)
+		return
+	}
+	tc.parsedURL, tc.labels = u, labels
+	p.Proxy.serveTarget(wr, req, tc, timeout)
+}
+
+// parseTarget accepts "host:port", "host:port/path" or a full http(s) URL.
+// Targets without a path get defaultPath.
+func (p *Probe) parseTarget(target, defaultPath string) (*url.URL, error) {
+	if target == "" {
+		return nil, fmt.Errorf("missing target parameter")
+	}
+	if !strings.Contains(target, "://") {
+		target = "http://" + target
+	}
+
+	u, err := url.Parse(target)
+	if err != nil {
+		return nil, fmt.Errorf("invalid target: %w", err)
+	}
+	if u.Scheme != "http" && u.Scheme != "https" {
+		return nil, fmt.Errorf("invalid target %q: unsupported scheme %q", target, u.Scheme)
+	}
+	if u.User != nil || u.Fragment != "" {
+		return nil, fmt.Errorf("invalid target %q: credentials and fragments are not allowed", target)
+	}
+	if _, _, err := net.SplitHostPort(u.Host); err != nil {
+		return nil, fmt.Errorf("invalid target %q: %w", target, err)
+	}
+	if u.Path == "" || u.Path == "/" {
+		u.Path = defaultPath
+	}
+	return u, nil
+}
+
+// parseTimeoutParam parses the "timeout" parameter of requests, either a
+// duration like "10s" or a number of seconds. An empty parameter gives 0.
+func parseTimeoutParam(param string) (time.Duration, error) {
+	if param == "" {
+		return 0, nil
+	}
+	timeout, err := time.ParseDuration(param)
+	if err != nil {
+		seconds, ferr := strconv.ParseFloat(param, 64)
+		if ferr != nil {
+			return 0, fmt.Errorf("invalid timeout parameter %q", param)
+		}
+		timeout = time.Duration(seconds * float64(time.Second))
+	}
+	if timeout <= 0 {
+		return 0, fmt.Errorf("invalid timeout parameter %q: must be positive", param)
+	}
+	return timeout, nil
+}
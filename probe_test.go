@@ -0,0 +1,53 @@
+package main
+
+import (
+	"testing"
+	"time"
+)
+
+func TestParseTimeoutParam(t *testing.T) {
+	tests := []struct {
+		param   string
+		want    time.Duration
+		wantErr bool
+	}{
+		{param: "", want: 0},
+		{param: "10s", want: 10 * time.Second},
+		{param: "2.5", want: 2500 * time.Millisecond},
+		{param: "0", wantErr: true},
+		{param: "0s", wantErr: true},
+		{param: "-5s", wantErr: true},
+		{param: "-1", wantErr: true},
+		{param: "soon", wantErr: true},
+	}
+	for _, tt := range tests {
+		got, err := parseTimeoutParam(tt.param)
+		if (err != nil) != tt.wantErr || got != tt.want {
+			t.Errorf("parseTimeoutParam(%q) = %v, %v; want %v, error %v", tt.param, got, err, tt.want, tt.wantErr)
+		}
+	}
+}
+
+func TestTargetTimeoutCapsOverride(t *testing.T) {
+	tests := []struct {
+		name     string
+		client   time.Duration
+		target   time.Duration
+		override time.Duration
+		want     time.Duration
+	}{
+		{name: "client", client: 30 * time.Second, want: 30 * time.Second},
+		{name: "target", client: 30 * time.Second, target: 5 * time.Second, want: 5 * time.Second},
+		{name: "shorter override", client: 30 * time.Second, override: 10 * time.Second, want: 10 * time.Second},
+		{name: "longer override", client: 30 * time.Second, override: time.Hour, want: 30 * time.Second},
+		{name: "longer override than target", client: 30 * time.Second, target: 5 * time.Second, override: 10 * time.Second, want: 5 * time.Second},
+		{name: "override without timeout", override: time.Hour, want: time.Hour},
+	}
+	for _, tt := range tests {
+		p := &Proxy{}
+		p.Client.Timeout = tt.client
+		if got := p.targetTimeout(&TargetConfig{Timeout: tt.target}, tt.override); got != tt.want {
+			t.Errorf("%s: got %v, want %v", tt.name, got, tt.want)
+		}
+	}
+}
@@ -0,0 +1,102 @@
+package main
+
+import (
+	"errors"
+	"net"
+	"sync"
+	"time"
+)
+
+var errRateLimited = errors.New("too many requests")
+
+// RateLimiter limits incoming requests by token buckets, globally and per
+// client address. Limits are in requests per second and disabled if not
+// positive.
+type RateLimiter struct {
+	Global    float64
+	PerClient float64
+	Burst     int // size of buckets, at least 1
+
+	mu        sync.Mutex
+	global    tokenBucket
+	clients   map[string]*tokenBucket
+	lastSweep time.Time
+}
+
+// Allow takes a token for a request from remoteAddr, or returns
+// errRateLimited if either limit is exceeded.
+func (rl *RateLimiter) Allow(remoteAddr string) error {
+	if rl == nil {
+		return nil
+	}
+	now := time.Now()
+	burst := float64(rl.Burst)
+	if burst < 1 {
+		burst = 1
+	}
+
+	rl.mu.Lock()
+	defer rl.mu.Unlock()
+	var client *tokenBucket
+	if rl.PerClient > 0 {
+		host, _, err := net.SplitHostPort(remoteAddr)
+		if err != nil {
+			host = remoteAddr
+		}
+		rl.sweep(now, burst)
+		client = rl.clients[host]
+		if client == nil {
+			if rl.clients == nil {
+				rl.clients = make(map[string]*tokenBucket)
+			}
+			client = &tokenBucket{tokens: burst, last: now}
+			rl.clients[host] = client
+		}
+		client.refill(now, rl.PerClient, burst)
+		if client.tokens < 1 {
+			return errRateLimited
+		}
+	}
+	if rl.Global > 0 {
+		if rl.global.last.IsZero() {
+			rl.global = tokenBucket{tokens: burst, last: now}
+		}
+		rl.global.refill(now, rl.Global, burst)
+		if rl.global.tokens < 1 {
+			return errRateLimited
+		}
+		rl.global.tokens--
+	}
+	if client != nil {
+		client.tokens--
+	}
+	return nil
+}
+
+// sweep forgets clients whose buckets are full again, once a minute, so that
+// the map doesn't grow with every address ever seen.
+func (rl *RateLimiter) sweep(now time.Time, burst float64) {
+	if now.Sub(rl.lastSweep) < time.Minute {
+		return
+	}
+	rl.lastSweep = now
+	for host, b := range rl.clients {
+		if b.refill(now, rl.PerClient, burst); b.tokens >= burst {
+			delete(rl.clients, host)
+		}
+	}
+}
+
+// tokenBucket holds tokens refilled at a constant rate up to the burst size.
+type tokenBucket struct {
+	tokens float64
+	last   time.Time
+}
+
+func (b *tokenBucket) refill(now time.Time, rate float64, burst float64) {
+	b.tokens += now.Sub(b.last).Seconds() * rate
+	if b.tokens > burst {
+		b.tokens = burst
+	}
+	b.last = now
+}
@@ -0,0 +1,69 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"os"
+	"os/signal"
+	"sync"
+	"syscall"
+)
+
+// Reloader reloads the config of the proxy on SIGHUP or POST requests.
+// Requests in flight finish with the previous config.
+type Reloader struct {
+	Proxy *Proxy
+
+	// Load returns the new config.
+	Load func() (*Config, error)
+
+	// Context limits the background scrapes of reloaded targets.
+	Context context.Context
+
+	mu sync.Mutex
+}
+
+// WatchSIGHUP reloads the config on every SIGHUP until ctx is done.
+func (r *Reloader) WatchSIGHUP(ctx context.Context) {
+	hup := make(chan os.Signal, 1)
+	signal.Notify(hup, syscall.SIGHUP)
+	defer signal.Stop(hup)
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-hup:
+			if err := r.Reload(); err != nil {
+				slog.Error("failed to reload config", "err", err)
+			}
+		}
+	}
+}
+
+// Reload loads the config and applies it, unless it's invalid.
+func (r *Reloader) Reload() error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	cfg, err := r.Load()
+	if err != nil {
+		return err
+	}
+	r.Proxy.SetConfig(cfg)
+	r.Proxy.Scheduler.Start(r.Context, cfg.Targets)
+	slog.Info("reloaded config", "targets", len(cfg.Targets))
+	return nil
+}
+
+func (r *Reloader) ServeHTTP(wr http.ResponseWriter, req *http.Request) {
+	if req.Method != http.MethodPost && req.Method != http.MethodPut {
+		wr.Header().Set("Allow", "POST, PUT")
+		r.Proxy.sendError(wr, http.StatusMethodNotAllowed, fmt.Errorf("use POST to reload the config"))
+		return
+	}
+	if err := r.Reload(); err != nil {
+		slog.Error("failed to reload config", "err", err)
+		r.Proxy.sendError(wr, http.StatusInternalServerError, fmt.Errorf("failed to reload config: %w", err))
+	}
+}
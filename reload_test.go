@@ -0,0 +1,93 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func TestReloadKeepsSnapshotsOfUnchangedTargets(t *testing.T) {
+	var scrapes atomic.Int64
+	block := make(chan struct{})
+	target := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		if scrapes.Add(1) > 1 {
+			// Only the first scrape succeeds quickly, so that results after
+			// the reload can only come from before it.
+			select {
+			case <-block:
+			case <-req.Context().Done():
+			}
+		}
+		fmt.Fprint(w, `{"requests": 7}`)
+	}))
+	defer target.Close()
+	defer close(block)
+
+	path := filepath.Join(t.TempDir(), "config.yml")
+	write := func(config string) {
+		if err := os.WriteFile(path, []byte(config), 0o600); err != nil {
+			t.Fatal(err)
+		}
+	}
+	config := fmt.Sprintf("targets:\n  - name: app\n    url: %s/debug/vars\n    interval: 1h\n", target.URL)
+	write(config)
+
+	p := &Proxy{Decimals: -1}
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	reloader := &Reloader{Proxy: p, Load: func() (*Config, error) { return LoadConfig(path) }, Context: ctx}
+	p.Scheduler = &Scheduler{Proxy: p}
+	if err := reloader.Reload(); err != nil {
+		t.Fatal(err)
+	}
+	waitReady(t, p.Scheduler)
+	lastSamples := p.Config().Targets[0].lastSamples.Load()
+
+	// Reloading the same config keeps the snapshot and the size hint.
+	if err := reloader.Reload(); err != nil {
+		t.Fatal(err)
+	}
+	if !p.Scheduler.Ready() {
+		t.Error("not ready after reloading an unchanged target")
+	}
+	tc := p.Config().Targets[0]
+	if got := tc.lastSamples.Load(); got != lastSamples || got == 0 {
+		t.Errorf("got size hint %d after reload, want %d", got, lastSamples)
+	}
+	reqCtx, reqCancel := context.WithTimeout(context.Background(), time.Second)
+	defer reqCancel()
+	result, err := p.Scheduler.Latest(reqCtx, tc)
+	if err != nil || len(result.samples) != 1 {
+		t.Errorf("got %d samples and error %v after reload, want the previous result", len(result.samples), err)
+	}
+
+	// Changed targets start over.
+	write(config + "    labels: {env: prod}\n")
+	if err := reloader.Reload(); err != nil {
+		t.Fatal(err)
+	}
+	if p.Scheduler.Ready() {
+		t.Error("ready before the first scrape of a changed target")
+	}
+	if got := p.Config().Targets[0].lastSamples.Load(); got != 0 {
+		t.Errorf("got size hint %d for a changed target, want 0", got)
+	}
+}
+
+// waitReady waits for the first scrapes of the scheduler.
+func waitReady(t *testing.T, s *Scheduler) {
+	t.Helper()
+	deadline := time.Now().Add(5 * time.Second)
+	for !s.Ready() {
+		if time.Now().After(deadline) {
+			t.Fatal("scheduler isn't ready")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
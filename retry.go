@@ -0,0 +1,97 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"io"
+	"log/slog"
+	"math/rand"
+	"net/http"
+	"net/url"
+	"time"
+
+	"github.com/relex/prometheus-expvar-proxy/expvarcollector"
+)
+
+// get requests the target, retrying connection errors and 5xx responses up
+// to p.Retries times with exponential backoff, as long as the backoff ends
+// before the client timeout of the whole scrape. Requests and backoffs are
+// canceled with ctx.
+func (p *Proxy) get(ctx context.Context, client *http.Client, tc *TargetConfig, target *url.URL) (*http.Response, error) {
+	var deadline time.Time
+	if client.Timeout > 0 {
+		deadline = time.Now().Add(client.Timeout)
+	}
+	backoff := p.RetryBackoff
+	for attempt := 0; ; attempt++ {
+		resp, err := p.getOnce(ctx, client, tc, target, deadline)
+		if err == nil || attempt >= p.Retries {
+			return resp, err
+		}
+
+		wait := jittered(backoff, p.RetryJitter)
+		if !deadline.IsZero() && time.Now().Add(wait).After(deadline) {
+			return nil, err
+		}
+		slog.Info("retrying scrape of target", "target", target.Redacted(), "wait", wait, "err", err)
+		timer := time.NewTimer(wait)
+		select {
+		case <-ctx.Done():
+			timer.Stop()
+			return nil, err
+		case <-timer.C:
+		}
+		backoff *= 2
+	}
+}
+
+// getOnce requests the target, failing if its response is a server error.
+// The client timeout is limited to the deadline of all attempts if set.
+// Targets of modules with MBeans get a POST of the bulk read request.
+func (p *Proxy) getOnce(ctx context.Context, client *http.Client, tc *TargetConfig, target *url.URL, deadline time.Time) (*http.Response, error) {
+	method, body := http.MethodGet, io.Reader(nil)
+	if tc.module != nil && tc.module.readRequest != nil {
+		method, body = http.MethodPost, bytes.NewReader(tc.module.readRequest)
+	}
+	req, err := http.NewRequestWithContext(ctx, method, target.String(), body)
+	if err != nil {
+		return nil, fmt.Errorf("%w; error scraping %q: %w", expvarcollector.ErrTargetInaccessible, target, err)
+	}
+	req.Header.Set("Accept-Encoding", expvarcollector.AcceptEncoding)
+	if body != nil {
+		req.Header.Set("Content-Type", "application/json")
+	}
+	tc.addHeaders(req)
+	if !deadline.IsZero() {
+		// A zero timeout would be none at all.
+		remaining := time.Until(deadline)
+		if remaining <= 0 {
+			return nil, fmt.Errorf("%w; error scraping %q: %w", expvarcollector.ErrTargetInaccessible, target, context.DeadlineExceeded)
+		}
+		c := *client
+		c.Timeout = remaining
+		client = &c
+	}
+	if err := tc.authorize(req, p.authClient(tc, client)); err != nil {
+		return nil, fmt.Errorf("error authorizing scrape of %q: %w", target, err)
+	}
+	resp, err := client.Do(req)
+	if err != nil {
+		return nil, fmt.Errorf("%w; error scraping %q: %w", expvarcollector.ErrTargetInaccessible, target, err)
+	}
+	if resp.StatusCode >= http.StatusInternalServerError {
+		io.Copy(io.Discard, io.LimitReader(resp.Body, 4096))
+		resp.Body.Close()
+		return nil, fmt.Errorf("error scraping %q: %s", target, resp.Status)
+	}
+	return resp, nil
+}
+
+// jittered returns d changed randomly by up to the fraction jitter.
+func jittered(d time.Duration, jitter float64) time.Duration {
+	if jitter <= 0 {
+		return d
+	}
+	return time.Duration(float64(d) * (1 + jitter*(2*rand.Float64()-1)))
+}
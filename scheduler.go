@@ -0,0 +1,155 @@
+package main
+
+import (
+	"context"
+	"log/slog"
+	"sync"
+	"time"
+)
+
+// Scheduler scrapes configured targets in the background on their interval,
+// so that requests are served the latest result without waiting for slow
+// targets.
+type Scheduler struct {
+	Proxy *Proxy
+
+	// Interval applies to targets without their own interval. Targets aren't
+	// scraped in the background if both are zero.
+	Interval time.Duration
+
+	mu        sync.Mutex
+	snapshots map[*TargetConfig]*snapshot
+	stop      context.CancelFunc // of the targets of the last Start
+}
+
+// snapshot is the latest result of a scheduled target.
+type snapshot struct {
+	ready     chan struct{} // closed after the first scrape
+	readyOnce sync.Once
+	result    scrapeResult
+	err       error
+}
+
+// Start starts scraping the targets with an interval until ctx is done. The
+// targets of previous calls aren't scraped anymore, but those that didn't
+// change keep serving their latest result until they're scraped again, so
+// that reloads don't make the proxy unready.
+func (s *Scheduler) Start(ctx context.Context, targets []*TargetConfig) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.stop != nil {
+		s.stop()
+	}
+	ctx, s.stop = context.WithCancel(ctx)
+	previous := make(map[string]*TargetConfig, len(s.snapshots))
+	for t := range s.snapshots {
+		previous[t.Name] = t
+	}
+	snapshots := make(map[*TargetConfig]*snapshot)
+	for _, t := range targets {
+		interval := s.interval(t)
+		if interval <= 0 {
+			continue
+		}
+		snap := &snapshot{ready: make(chan struct{})}
+		if old := previous[t.Name]; t.unchanged(old) {
+			snap = s.snapshots[old]
+		}
+		snapshots[t] = snap
+		go s.run(ctx, t, interval, snap)
+	}
+	s.snapshots = snapshots
+}
+
+func (s *Scheduler) interval(t *TargetConfig) time.Duration {
+	if t.Interval > 0 {
+		return t.Interval
+	}
+	return s.Interval
+}
+
+// timeout returns the timeout of the target, or of the client of the proxy.
+func (s *Scheduler) timeout(t *TargetConfig) time.Duration {
+	if t.Timeout > 0 {
+		return t.Timeout
+	}
+	return s.Proxy.Client.Timeout
+}
+
+func (s *Scheduler) run(ctx context.Context, t *TargetConfig, interval time.Duration, snap *snapshot) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		result, err := s.Proxy.Cache.Get(ctx, t.key(), func(ctx context.Context) (scrapeResult, error) {
+			timeout := s.timeout(t)
+			if timeout > 0 {
+				var cancel context.CancelFunc
+				ctx, cancel = context.WithTimeout(ctx, timeout)
+				defer cancel()
+			}
+			return s.Proxy.scrape(ctx, t, timeout)
+		})
+		if err != nil {
+			slog.Warn("failed to scrape target in background", "target", t.Name, "duration", result.duration, "err", err)
+		}
+		if ctx.Err() != nil {
+			// The target was reloaded or stopped, and the result of this
+			// scrape may be older than that of its successor.
+			return
+		}
+		s.mu.Lock()
+		snap.result, snap.err = result, err
+		s.mu.Unlock()
+		snap.readyOnce.Do(func() { close(snap.ready) })
+
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+	}
+}
+
+// Ready returns whether all scheduled targets got their first scrape.
+func (s *Scheduler) Ready() bool {
+	if s == nil {
+		return true
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for _, snap := range s.snapshots {
+		select {
+		case <-snap.ready:
+		default:
+			return false
+		}
+	}
+	return true
+}
+
+// Scheduled returns whether the target is scraped in the background.
+func (s *Scheduler) Scheduled(t *TargetConfig) bool {
+	if s == nil {
+		return false
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.snapshots[t] != nil
+}
+
+// Latest returns the latest result of a scheduled target, waiting for the
+// first scrape if needed.
+func (s *Scheduler) Latest(ctx context.Context, t *TargetConfig) (scrapeResult, error) {
+	s.mu.Lock()
+	snap := s.snapshots[t]
+	s.mu.Unlock()
+
+	select {
+	case <-snap.ready:
+	case <-ctx.Done():
+		return scrapeResult{}, ctx.Err()
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return snap.result, snap.err
+}
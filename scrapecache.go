@@ -0,0 +1,157 @@
+package main
+
+import (
+	"context"
+	"sync"
+	"time"
+
+	"github.com/relex/prometheus-expvar-proxy/expvarcollector"
+)
+
+// ScrapeCache keeps the samples of targets for TTL, so that several scrapers
+// of the same target within the TTL cause only one upstream scrape. Scrapes
+// of a target in flight are shared by all requests waiting for them.
+//
+// With a positive Grace, the last successful samples of targets are kept for
+// that long to be served as stale when scrapes fail.
+type ScrapeCache struct {
+	TTL   time.Duration
+	Grace time.Duration
+
+	mu      sync.Mutex
+	entries map[string]*cachedScrape
+	last    map[string]*cachedScrape // successful, if Grace is positive
+}
+
+type cachedScrape struct {
+	done    chan struct{} // closed when the scrape is finished
+	result  scrapeResult
+	err     error
+	expires time.Time
+}
+
+// Get returns the cached result of the key, or the result of scrape shared
+// with other callers. The samples are shared as well and must not be
+// modified. A nil cache calls scrape every time.
+//
+// Shared scrapes run detached from the context of the caller that started
+// them, so that callers only stop waiting for them when their own ctx is
+// done, without failing the scrape for the others. scrape must therefore
+// limit its own duration.
+func (sc *ScrapeCache) Get(ctx context.Context, key string, scrape func(context.Context) (scrapeResult, error)) (scrapeResult, error) {
+	if sc == nil {
+		return scrape(ctx)
+	}
+
+	start := time.Now()
+	sc.mu.Lock()
+	sc.expire(start)
+	e, ok := sc.entries[key]
+	if ok {
+		sc.mu.Unlock()
+		expvarCacheHits.Add(1)
+	} else {
+		e = &cachedScrape{done: make(chan struct{})}
+		if sc.entries == nil {
+			sc.entries = make(map[string]*cachedScrape)
+		}
+		sc.entries[key] = e
+		sc.mu.Unlock()
+		expvarCacheMisses.Add(1)
+		go sc.run(context.WithoutCancel(ctx), key, e, scrape)
+	}
+
+	select {
+	case <-e.done:
+		return e.result, e.err
+	case <-ctx.Done():
+		return scrapeResult{duration: time.Since(start)}, ctx.Err()
+	}
+}
+
+// run scrapes for the entry of the key and makes the result available to
+// the callers waiting for it.
+func (sc *ScrapeCache) run(ctx context.Context, key string, e *cachedScrape, scrape func(context.Context) (scrapeResult, error)) {
+	e.result, e.err = scrape(ctx)
+
+	sc.mu.Lock()
+	if e.err == nil {
+		e.expires = time.Now().Add(sc.TTL)
+		if sc.Grace > 0 {
+			if sc.last == nil {
+				sc.last = make(map[string]*cachedScrape)
+			}
+			sc.last[key] = e
+		}
+	} else {
+		// Failures are only shared with the callers already waiting.
+		delete(sc.entries, key)
+	}
+	sc.mu.Unlock()
+	close(e.done)
+}
+
+// Reset drops all finished scrapes, e.g. after the config changed.
+func (sc *ScrapeCache) Reset() {
+	if sc == nil {
+		return
+	}
+	sc.mu.Lock()
+	defer sc.mu.Unlock()
+	for key, e := range sc.entries {
+		if !e.expires.IsZero() {
+			delete(sc.entries, key)
+		}
+	}
+	sc.last = nil
+}
+
+// Stale returns the last successful result of the key if it was scraped
+// within Grace. The samples must not be modified.
+func (sc *ScrapeCache) Stale(key string) (scrapeResult, bool) {
+	if sc == nil {
+		return scrapeResult{}, false
+	}
+	sc.mu.Lock()
+	defer sc.mu.Unlock()
+	sc.expire(time.Now())
+	e, ok := sc.last[key]
+	if !ok {
+		return scrapeResult{}, false
+	}
+	return e.result, true
+}
+
+// expire removes finished scrapes older than TTL, and successful ones older
+// than Grace.
+func (sc *ScrapeCache) expire(now time.Time) {
+	for key, e := range sc.entries {
+		if !e.expires.IsZero() && !now.Before(e.expires) {
+			delete(sc.entries, key)
+		}
+	}
+	for key, e := range sc.last {
+		if !now.Before(e.expires.Add(sc.Grace - sc.TTL)) {
+			delete(sc.last, key)
+		}
+	}
+}
+
+// staleFamilies returns expvar_stale, which tells whether the samples were
+// served stale after a failed scrape.
+func staleFamilies(labels []Label, stale bool) []metricFamily {
+	labels = append([]Label(nil), labels...)
+	expvarcollector.SortLabels(labels)
+	isStale := 0.0
+	if stale {
+		isStale = 1
+	}
+	return []metricFamily{
+		{
+			Name:    "expvar_stale",
+			Help:    "Whether the metrics are from a previous successful scrape, because the last one failed.",
+			Type:    "gauge",
+			Samples: []sample{{Name: "expvar_stale", Labels: labels, Value: isStale}},
+		},
+	}
+}
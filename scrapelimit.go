@@ -0,0 +1,66 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"sync/atomic"
+)
+
+var (
+	errNoScrapeSlot = errors.New("no free scrape slot")
+
+	// errQueueFull is returned by ScrapeLimiter.Acquire if too many scrapes
+	// wait.
+	errQueueFull = errors.New("too many scrapes waiting")
+)
+
+// ScrapeLimiter limits the number of simultaneous upstream scrapes. Scrapes
+// beyond the limit wait in a queue until a slot is released, their request is
+// canceled or, if the queue is limited and full, fail straight away.
+type ScrapeLimiter struct {
+	slots    chan struct{}
+	maxQueue int64 // no limit if not positive
+	queued   atomic.Int64
+}
+
+// NewScrapeLimiter returns a limiter of maxConcurrent scrapes with at most
+// maxQueue waiting, or unlimited waiting scrapes if maxQueue is 0.
+func NewScrapeLimiter(maxConcurrent, maxQueue int) *ScrapeLimiter {
+	return &ScrapeLimiter{
+		slots:    make(chan struct{}, maxConcurrent),
+		maxQueue: int64(maxQueue),
+	}
+}
+
+// Acquire waits for a free slot. Release must be called after the scrape if
+// no error is returned. A nil limiter doesn't limit anything.
+func (l *ScrapeLimiter) Acquire(ctx context.Context) error {
+	if l == nil {
+		return nil
+	}
+	select {
+	case l.slots <- struct{}{}:
+		return nil
+	default:
+	}
+
+	if n := l.queued.Add(1); l.maxQueue > 0 && n > l.maxQueue {
+		l.queued.Add(-1)
+		return errQueueFull
+	}
+	defer l.queued.Add(-1)
+	select {
+	case l.slots <- struct{}{}:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+// Release frees the slot taken by Acquire.
+func (l *ScrapeLimiter) Release() {
+	if l == nil {
+		return
+	}
+	<-l.slots
+}
@@ -0,0 +1,40 @@
+package main
+
+import (
+	"context"
+	"log/slog"
+	"time"
+
+	"github.com/coreos/go-systemd/v22/daemon"
+)
+
+// notifySystemd sends state, e.g. daemon.SdNotifyReady, to systemd if the
+// proxy runs in a unit of Type=notify, and does nothing otherwise.
+func notifySystemd(state string) {
+	if _, err := daemon.SdNotify(false, state); err != nil {
+		slog.Warn("failed to notify systemd", "state", state, "err", err)
+	}
+}
+
+// watchSystemd sends keepalives to systemd at half the WatchdogSec of the
+// unit until ctx is done, if the watchdog is enabled.
+func watchSystemd(ctx context.Context) {
+	interval, err := daemon.SdWatchdogEnabled(false)
+	if err != nil {
+		slog.Warn("invalid systemd watchdog", "err", err)
+		return
+	}
+	if interval <= 0 {
+		return
+	}
+	ticker := time.NewTicker(interval / 2)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+			notifySystemd(daemon.SdNotifyWatchdog)
+		}
+	}
+}
@@ -0,0 +1,23 @@
+//go:build !windows
+
+package main
+
+import (
+	"context"
+	"errors"
+	"log/slog"
+)
+
+// isService returns whether the proxy was started by the Windows service
+// manager, which is never the case on other systems.
+func isService() bool {
+	return false
+}
+
+func newServiceLogger(level string, format string) (*slog.Logger, error) {
+	return nil, errors.New("services are only supported on Windows")
+}
+
+func serviceContext(ctx context.Context) (context.Context, func()) {
+	return ctx, func() {}
+}
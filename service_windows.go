@@ -0,0 +1,121 @@
+//go:build windows
+
+package main
+
+import (
+	"bytes"
+	"context"
+	"log/slog"
+	"strings"
+	"sync"
+
+	"golang.org/x/sys/windows/svc"
+	"golang.org/x/sys/windows/svc/eventlog"
+)
+
+// isService returns whether the proxy was started by the Windows service
+// manager.
+func isService() bool {
+	ok, err := svc.IsWindowsService()
+	return err == nil && ok
+}
+
+// newServiceLogger returns a logger writing to the Windows event log, with the
+// source of the service name. The source needs to be registered, e.g. with
+// New-EventLog in PowerShell.
+func newServiceLogger(level string, format string) (*slog.Logger, error) {
+	elog, err := eventlog.Open(programName)
+	if err != nil {
+		return nil, err
+	}
+	buf := &bytes.Buffer{}
+	logger, err := newLogger(buf, level, format)
+	if err != nil {
+		return nil, err
+	}
+	return slog.New(&eventLogHandler{Handler: logger.Handler(), log: elog, buf: buf, mu: &sync.Mutex{}}), nil
+}
+
+// eventLogHandler writes the records formatted by Handler into buf to the
+// event log, with the type of event by level.
+type eventLogHandler struct {
+	slog.Handler
+	log *eventlog.Log
+	buf *bytes.Buffer
+	mu  *sync.Mutex // of buf, shared by handlers with more attributes
+}
+
+func (h *eventLogHandler) Handle(ctx context.Context, r slog.Record) error {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	h.buf.Reset()
+	if err := h.Handler.Handle(ctx, r); err != nil {
+		return err
+	}
+	msg := strings.TrimSuffix(h.buf.String(), "\n")
+	switch {
+	case r.Level >= slog.LevelError:
+		return h.log.Error(1, msg)
+	case r.Level >= slog.LevelWarn:
+		return h.log.Warning(1, msg)
+	default:
+		return h.log.Info(1, msg)
+	}
+}
+
+func (h *eventLogHandler) WithAttrs(attrs []slog.Attr) slog.Handler {
+	return &eventLogHandler{Handler: h.Handler.WithAttrs(attrs), log: h.log, buf: h.buf, mu: h.mu}
+}
+
+func (h *eventLogHandler) WithGroup(name string) slog.Handler {
+	return &eventLogHandler{Handler: h.Handler.WithGroup(name), log: h.log, buf: h.buf, mu: h.mu}
+}
+
+// serviceContext returns a context canceled when the Windows service is
+// stopped, if the proxy runs as one, and a function to call once the proxy
+// has shut down, which reports the service as stopped.
+func serviceContext(ctx context.Context) (context.Context, func()) {
+	if !isService() {
+		return ctx, func() {}
+	}
+	ctx, cancel := context.WithCancel(ctx)
+	h := &serviceHandler{stop: cancel, stopped: make(chan struct{})}
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		if err := svc.Run(programName, h); err != nil {
+			slog.Error("failed to run as Windows service", "err", err)
+		}
+		cancel()
+	}()
+	return ctx, func() {
+		close(h.stopped)
+		<-done
+	}
+}
+
+// serviceHandler answers the requests of the Windows service manager.
+type serviceHandler struct {
+	stop    context.CancelFunc // makes the proxy shut down
+	stopped chan struct{}      // closed once the proxy has shut down
+}
+
+func (h *serviceHandler) Execute(_ []string, requests <-chan svc.ChangeRequest, status chan<- svc.Status) (bool, uint32) {
+	status <- svc.Status{State: svc.Running, Accepts: svc.AcceptStop | svc.AcceptShutdown}
+	for {
+		select {
+		case r := <-requests:
+			switch r.Cmd {
+			case svc.Interrogate:
+				status <- r.CurrentStatus
+			case svc.Stop, svc.Shutdown:
+				status <- svc.Status{State: svc.StopPending}
+				h.stop()
+				<-h.stopped
+				return false, 0
+			}
+		case <-h.stopped:
+			return false, 0
+		}
+	}
+}
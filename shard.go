@@ -0,0 +1,26 @@
+package main
+
+import (
+	"crypto/md5"
+	"encoding/binary"
+)
+
+// shardTargets returns the targets of shard index of total, split by the
+// hashmod of their names. The hash is that of the hashmod action of
+// Prometheus relabeling, so that the same split can be done there.
+func shardTargets(targets []*TargetConfig, index, total int) []*TargetConfig {
+	var shard []*TargetConfig
+	for _, t := range targets {
+		if hashmod(t.Name, total) == index {
+			shard = append(shard, t)
+		}
+	}
+	return shard
+}
+
+// hashmod returns the hash of s modulo m like Prometheus: the lower 64 bits
+// of its MD5 sum.
+func hashmod(s string, m int) int {
+	sum := md5.Sum([]byte(s))
+	return int(binary.BigEndian.Uint64(sum[8:]) % uint64(m))
+}
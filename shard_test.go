@@ -0,0 +1,46 @@
+package main
+
+import "testing"
+
+// TestHashmod compares hashmod with the hashmod action of Prometheus
+// relabeling, i.e. relabel.Process with source_labels of a single label
+// holding the value and modulus m. The expected shards were computed outside
+// of Go from the MD5 sums of the values, as Prometheus does.
+func TestHashmod(t *testing.T) {
+	moduli := []int{2, 3, 7, 16, 1000}
+	tests := []struct {
+		value string
+		want  []int // by modulus
+	}{
+		{"localhost:8080", []int{1, 0, 5, 15, 7}},
+		{"app-1.example.com:9100", []int{1, 0, 3, 3, 131}},
+		{"10.0.0.7:6060", []int{1, 1, 0, 3, 187}},
+		{"payments", []int{0, 2, 3, 10, 594}},
+		{"", []int{0, 1, 1, 14, 958}},
+	}
+	for _, tt := range tests {
+		for i, m := range moduli {
+			if got := hashmod(tt.value, m); got != tt.want[i] {
+				t.Errorf("hashmod(%q, %d) = %d, want %d", tt.value, m, got, tt.want[i])
+			}
+		}
+	}
+}
+
+func TestShardTargets(t *testing.T) {
+	targets := []*TargetConfig{{Name: "localhost:8080"}, {Name: "10.0.0.7:6060"}, {Name: "payments"}}
+	seen := make(map[string]int)
+	for index := 0; index < 3; index++ {
+		for _, tc := range shardTargets(targets, index, 3) {
+			seen[tc.Name]++
+			if want := hashmod(tc.Name, 3); index != want {
+				t.Errorf("target %q in shard %d, want %d", tc.Name, index, want)
+			}
+		}
+	}
+	for _, tc := range targets {
+		if seen[tc.Name] != 1 {
+			t.Errorf("target %q is in %d shards, want 1", tc.Name, seen[tc.Name])
+		}
+	}
+}
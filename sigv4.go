@@ -0,0 +1,255 @@
+package main
+
+import (
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/xml"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"os"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+// emptyPayloadHash is the SHA-256 of an empty body, as signed for GETs.
+const emptyPayloadHash = "e3b0c44298fc1c149afbf4c8996fb92427ae41e4649b934ca495991b7852b855"
+
+// SigV4Config configures AWS Signature Version 4 signing of requests to
+// targets, e.g. fronted by API Gateway with IAM auth.
+//
+// Credentials are AccessKey and SecretKey if set, or the AWS_ACCESS_KEY_ID,
+// AWS_SECRET_ACCESS_KEY and AWS_SESSION_TOKEN environment variables. With
+// RoleARN, they're only used to assume the role.
+type SigV4Config struct {
+	// Region defaults to the AWS_REGION environment variable.
+	Region    string `yaml:"region"`
+	AccessKey string `yaml:"access_key"`
+	SecretKey string `yaml:"secret_key"`
+	RoleARN   string `yaml:"role_arn"`
+
+	// Service is the signing name of the AWS service, "execute-api" by
+	// default.
+	Service string `yaml:"service"`
+
+	mu      sync.Mutex
+	assumed *awsCredentials // of RoleARN, until expiry
+}
+
+type awsCredentials struct {
+	AccessKeyID     string    `xml:"AccessKeyId"`
+	SecretAccessKey string    `xml:"SecretAccessKey"`
+	SessionToken    string    `xml:"SessionToken"`
+	Expiration      time.Time `xml:"Expiration"`
+}
+
+func (sc *SigV4Config) validate() error {
+	if sc.Region == "" {
+		sc.Region = os.Getenv("AWS_REGION")
+	}
+	if sc.Region == "" {
+		return fmt.Errorf("missing region")
+	}
+	if (sc.AccessKey == "") != (sc.SecretKey == "") {
+		return fmt.Errorf("access_key and secret_key must be set together")
+	}
+	if sc.Service == "" {
+		sc.Service = "execute-api"
+	}
+	return nil
+}
+
+// Sign signs the request, assuming the role with the client first if
+// needed. The body of requests with one must be replayable by GetBody.
+func (sc *SigV4Config) Sign(req *http.Request, client *http.Client) error {
+	creds, err := sc.credentials(req.Context(), client)
+	if err != nil {
+		return err
+	}
+	payloadHash := emptyPayloadHash
+	if req.GetBody != nil {
+		body, err := req.GetBody()
+		if err != nil {
+			return err
+		}
+		h := sha256.New()
+		_, err = io.Copy(h, body)
+		body.Close()
+		if err != nil {
+			return err
+		}
+		payloadHash = hex.EncodeToString(h.Sum(nil))
+	}
+	signRequest(req, payloadHash, creds, sc.Region, sc.Service, time.Now())
+	return nil
+}
+
+// credentials returns the credentials to sign requests with.
+func (sc *SigV4Config) credentials(ctx context.Context, client *http.Client) (*awsCredentials, error) {
+	base := &awsCredentials{AccessKeyID: sc.AccessKey, SecretAccessKey: sc.SecretKey}
+	if sc.AccessKey == "" {
+		base = &awsCredentials{
+			AccessKeyID:     os.Getenv("AWS_ACCESS_KEY_ID"),
+			SecretAccessKey: os.Getenv("AWS_SECRET_ACCESS_KEY"),
+			SessionToken:    os.Getenv("AWS_SESSION_TOKEN"),
+		}
+	}
+	if base.AccessKeyID == "" || base.SecretAccessKey == "" {
+		return nil, fmt.Errorf("no AWS credentials configured")
+	}
+	if sc.RoleARN == "" {
+		return base, nil
+	}
+
+	sc.mu.Lock()
+	defer sc.mu.Unlock()
+	if sc.assumed != nil && time.Now().Add(tokenExpiryDelta).Before(sc.assumed.Expiration) {
+		return sc.assumed, nil
+	}
+	assumed, err := assumeRole(ctx, client, base, sc.Region, sc.RoleARN)
+	if err != nil {
+		return nil, fmt.Errorf("error assuming role %q: %w", sc.RoleARN, err)
+	}
+	sc.assumed = assumed
+	return assumed, nil
+}
+
+// assumeRole gets temporary credentials of the role from STS.
+func assumeRole(ctx context.Context, client *http.Client, creds *awsCredentials, region, roleARN string) (*awsCredentials, error) {
+	body := url.Values{
+		"Action":          {"AssumeRole"},
+		"Version":         {"2011-06-15"},
+		"RoleArn":         {roleARN},
+		"RoleSessionName": {"prometheus-expvar-proxy"},
+	}.Encode()
+	endpoint := fmt.Sprintf("https://sts.%s.amazonaws.com/", region)
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, endpoint, strings.NewReader(body))
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	payloadHash := sha256.Sum256([]byte(body))
+	signRequest(req, hex.EncodeToString(payloadHash[:]), creds, region, "sts", time.Now())
+
+	resp, err := client.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	content, err := io.ReadAll(io.LimitReader(resp.Body, 1<<20))
+	if err != nil {
+		return nil, err
+	}
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("%s: %s", resp.Status, strings.TrimSpace(string(content)))
+	}
+	var result struct {
+		Credentials awsCredentials `xml:"AssumeRoleResult>Credentials"`
+	}
+	if err := xml.Unmarshal(content, &result); err != nil {
+		return nil, fmt.Errorf("invalid AssumeRole response: %w", err)
+	}
+	if result.Credentials.AccessKeyID == "" {
+		return nil, fmt.Errorf("no credentials in AssumeRole response")
+	}
+	return &result.Credentials, nil
+}
+
+// signRequest adds the SigV4 headers to req, whose body has the hex SHA-256
+// payloadHash.
+func signRequest(req *http.Request, payloadHash string, creds *awsCredentials, region, service string, now time.Time) {
+	amzDate := now.UTC().Format("20060102T150405Z")
+	date := amzDate[:8]
+	req.Header.Set("X-Amz-Date", amzDate)
+	if creds.SessionToken != "" {
+		req.Header.Set("X-Amz-Security-Token", creds.SessionToken)
+	}
+	host := req.Host
+	if host == "" {
+		host = req.URL.Host
+	}
+
+	headers := map[string]string{"host": host}
+	for name, values := range req.Header {
+		if name := strings.ToLower(name); strings.HasPrefix(name, "x-amz-") || name == "content-type" {
+			headers[name] = strings.TrimSpace(strings.Join(values, ","))
+		}
+	}
+	names := make([]string, 0, len(headers))
+	for name := range headers {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	var canonicalHeaders strings.Builder
+	for _, name := range names {
+		canonicalHeaders.WriteString(name + ":" + headers[name] + "\n")
+	}
+	signedHeaders := strings.Join(names, ";")
+
+	path := req.URL.EscapedPath()
+	if path == "" {
+		path = "/"
+	}
+	canonicalRequest := strings.Join([]string{
+		req.Method,
+		awsEscape(path, false),
+		canonicalQuery(req.URL.Query()),
+		canonicalHeaders.String(),
+		signedHeaders,
+		payloadHash,
+	}, "\n")
+
+	scope := date + "/" + region + "/" + service + "/aws4_request"
+	requestHash := sha256.Sum256([]byte(canonicalRequest))
+	stringToSign := "AWS4-HMAC-SHA256\n" + amzDate + "\n" + scope + "\n" + hex.EncodeToString(requestHash[:])
+
+	key := hmacSHA256([]byte("AWS4"+creds.SecretAccessKey), date)
+	key = hmacSHA256(key, region)
+	key = hmacSHA256(key, service)
+	key = hmacSHA256(key, "aws4_request")
+	signature := hex.EncodeToString(hmacSHA256(key, stringToSign))
+
+	req.Header.Set("Authorization", fmt.Sprintf("AWS4-HMAC-SHA256 Credential=%s/%s, SignedHeaders=%s, Signature=%s",
+		creds.AccessKeyID, scope, signedHeaders, signature))
+}
+
+// canonicalQuery returns the query sorted by keys and values, escaped as
+// required by SigV4.
+func canonicalQuery(query url.Values) string {
+	pairs := make([]string, 0, len(query))
+	for k, values := range query {
+		for _, v := range values {
+			pairs = append(pairs, awsEscape(k, true)+"="+awsEscape(v, true))
+		}
+	}
+	sort.Strings(pairs)
+	return strings.Join(pairs, "&")
+}
+
+// awsEscape percent-encodes everything but unreserved characters, and
+// slashes unless escapeSlash is set.
+func awsEscape(s string, escapeSlash bool) string {
+	var b strings.Builder
+	for i := 0; i < len(s); i++ {
+		c := s[i]
+		switch {
+		case 'A' <= c && c <= 'Z', 'a' <= c && c <= 'z', '0' <= c && c <= '9',
+			c == '-', c == '_', c == '.', c == '~', c == '/' && !escapeSlash:
+			b.WriteByte(c)
+		default:
+			fmt.Fprintf(&b, "%%%02X", c)
+		}
+	}
+	return b.String()
+}
+
+func hmacSHA256(key []byte, data string) []byte {
+	h := hmac.New(sha256.New, key)
+	h.Write([]byte(data))
+	return h.Sum(nil)
+}
@@ -0,0 +1,123 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"net"
+	"net/http"
+	"net/netip"
+	"net/url"
+	"path"
+	"strings"
+	"syscall"
+	"time"
+)
+
+// maxRedirects is the number of redirects followed, like by net/http.
+const maxRedirects = 10
+
+// privateNetworksDenied makes newTransport deny private networks, as set by
+// -targets.deny-private-networks.
+var privateNetworksDenied bool
+
+// denyPrivateNetworks makes the transport refuse connections to loopback,
+// private, link-local and unspecified addresses. The addresses are checked
+// when connecting, after resolving names, so that names resolving to such
+// addresses are refused as well. Proxies of the environment are dropped,
+// since the check would only see the address of the proxy.
+func denyPrivateNetworks(t *http.Transport) {
+	t.Proxy = nil
+	dialer := &net.Dialer{
+		Timeout:   30 * time.Second,
+		KeepAlive: 30 * time.Second,
+		Control: func(_, address string, _ syscall.RawConn) error {
+			host, _, err := net.SplitHostPort(address)
+			if err != nil {
+				return err
+			}
+			addr, err := netip.ParseAddr(host)
+			if err != nil {
+				return err
+			}
+			if isPrivateAddr(addr.Unmap()) {
+				return fmt.Errorf("connections to private address %s are denied", addr)
+			}
+			return nil
+		},
+	}
+	t.DialContext = dialer.DialContext
+}
+
+// isPrivateAddr returns whether addr isn't a public unicast address.
+func isPrivateAddr(addr netip.Addr) bool {
+	return addr.IsLoopback() || addr.IsPrivate() || addr.IsLinkLocalUnicast() ||
+		addr.IsLinkLocalMulticast() || addr.IsInterfaceLocalMulticast() || addr.IsUnspecified()
+}
+
+// checkRedirect only follows redirects to http:// and https:// URLs.
+func checkRedirect(req *http.Request, via []*http.Request) error {
+	if len(via) >= maxRedirects {
+		return errors.New("stopped after 10 redirects")
+	}
+	if req.URL.Scheme != "http" && req.URL.Scheme != "https" {
+		return fmt.Errorf("redirect to unsupported scheme %q", req.URL.Scheme)
+	}
+	return nil
+}
+
+// TargetAllowlist lists glob patterns of "host:port" of targets that clients
+// may ask to scrape, e.g. "*.internal:8080" or "10.1.*:*". An empty list
+// allows all targets.
+type TargetAllowlist []string
+
+// ParseTargetAllowlist parses a comma-separated list of patterns.
+func ParseTargetAllowlist(list string) (TargetAllowlist, error) {
+	var allowlist TargetAllowlist
+	for _, pattern := range strings.Split(list, ",") {
+		pattern = strings.ToLower(strings.TrimSpace(pattern))
+		if pattern == "" {
+			continue
+		}
+		if _, err := path.Match(pattern, ""); err != nil {
+			return nil, fmt.Errorf("invalid target pattern %q: %w", pattern, err)
+		}
+		if !strings.Contains(pattern, ":") {
+			return nil, fmt.Errorf("invalid target pattern %q: must match host:port", pattern)
+		}
+		allowlist = append(allowlist, pattern)
+	}
+	return allowlist, nil
+}
+
+// Allowed returns whether the target URL is allowed. Ports default to the
+// ones of the scheme.
+func (al TargetAllowlist) Allowed(u *url.URL) bool {
+	if len(al) == 0 {
+		return true
+	}
+	port := u.Port()
+	if port == "" {
+		port = "80"
+		if u.Scheme == "https" {
+			port = "443"
+		}
+	}
+	hostPort := net.JoinHostPort(strings.ToLower(u.Hostname()), port)
+	for _, pattern := range al {
+		if ok, _ := path.Match(pattern, hostPort); ok {
+			return true
+		}
+	}
+	return false
+}
+
+// CheckRedirect follows redirects only to allowed http:// and https:// URLs.
+func (al TargetAllowlist) CheckRedirect(req *http.Request, via []*http.Request) error {
+	if err := checkRedirect(req, via); err != nil {
+		return err
+	}
+	if !al.Allowed(req.URL) {
+		return fmt.Errorf("redirect to %s, which isn't an allowed target", req.URL.Host)
+	}
+	return nil
+}
@@ -0,0 +1,105 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"net/netip"
+	"strings"
+	"testing"
+)
+
+func TestIsPrivateAddr(t *testing.T) {
+	tests := []struct {
+		addr    string
+		private bool
+	}{
+		{"127.0.0.1", true},
+		{"127.1.2.3", true},
+		{"10.0.0.1", true},
+		{"172.16.5.4", true},
+		{"192.168.1.10", true},
+		{"169.254.169.254", true}, // cloud metadata
+		{"0.0.0.0", true},
+		{"::1", true},
+		{"::", true},
+		{"fe80::1", true},
+		{"fd00::1", true},
+		{"ff02::1", true},
+		{"8.8.8.8", false},
+		{"172.32.0.1", false},
+		{"2001:4860:4860::8888", false},
+	}
+	for _, tt := range tests {
+		if got := isPrivateAddr(netip.MustParseAddr(tt.addr)); got != tt.private {
+			t.Errorf("isPrivateAddr(%s) = %v, want %v", tt.addr, got, tt.private)
+		}
+	}
+}
+
+// denyPrivateNetworksForTest makes newTransport deny private networks until
+// the end of the test.
+func denyPrivateNetworksForTest(t *testing.T) {
+	privateNetworksDenied = true
+	t.Cleanup(func() { privateNetworksDenied = false })
+}
+
+// redirectingTransport answers requests to public.example with a redirect to
+// location, and passes others to next.
+type redirectingTransport struct {
+	location string
+	next     http.RoundTripper
+}
+
+func (rt *redirectingTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	if req.URL.Host != "public.example" {
+		return rt.next.RoundTrip(req)
+	}
+	rec := httptest.NewRecorder()
+	http.Redirect(rec, req, rt.location, http.StatusFound)
+	return rec.Result(), nil
+}
+
+func TestDenyPrivateNetworks(t *testing.T) {
+	internal := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		w.Write([]byte(`{"secret": 1}`))
+	}))
+	defer internal.Close()
+
+	denyPrivateNetworksForTest(t)
+	transport, err := newTransport(&TLSConfig{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if transport.Proxy != nil {
+		t.Error("proxies of the environment are used")
+	}
+	client := &http.Client{Transport: transport, CheckRedirect: checkRedirect}
+
+	if _, err := client.Get(internal.URL); err == nil || !strings.Contains(err.Error(), "denied") {
+		t.Errorf("got error %v for a private target, want denied", err)
+	}
+
+	client.Transport = &redirectingTransport{location: internal.URL, next: transport}
+	if _, err := client.Get("http://public.example/debug/vars"); err == nil || !strings.Contains(err.Error(), "denied") {
+		t.Errorf("got error %v for a redirect to a private target, want denied", err)
+	}
+}
+
+func TestDenyPrivateNetworksRefusesProxyURL(t *testing.T) {
+	denyPrivateNetworksForTest(t)
+	tc := &TargetConfig{URL: "http://app:8080/debug/vars", ProxyURL: "http://proxy:3128"}
+	if err := tc.buildTransport(""); err == nil {
+		t.Error("proxy_url was accepted")
+	}
+	tc.ProxyURL = ""
+	tc.TLS = &TLSConfig{}
+	if err := tc.buildTransport(""); err != nil {
+		t.Fatal(err)
+	}
+	internal := httptest.NewServer(http.NotFoundHandler())
+	defer internal.Close()
+	client := &http.Client{Transport: tc.transport}
+	if _, err := client.Get(internal.URL); err == nil || !strings.Contains(err.Error(), "denied") {
+		t.Errorf("got error %v from the transport of the target, want denied", err)
+	}
+}
@@ -0,0 +1,115 @@
+package main
+
+import (
+	"net/http"
+	"strconv"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/collectors"
+	versioncollector "github.com/prometheus/client_golang/prometheus/collectors/version"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
+)
+
+// Telemetry holds the metrics of the proxy itself, as opposed to the metrics
+// of its targets. A nil Telemetry records nothing.
+type Telemetry struct {
+	Registry *prometheus.Registry
+
+	requests     *prometheus.CounterVec
+	scrapes      prometheus.Counter
+	scrapeErrors prometheus.Counter
+	scrapedBytes prometheus.Counter
+}
+
+// NewTelemetry returns the metrics of the proxy, registered along with the
+// process and Go collectors.
+func NewTelemetry() *Telemetry {
+	t := &Telemetry{
+		Registry: prometheus.NewRegistry(),
+		requests: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Name: "expvar_exporter_requests_total",
+			Help: "Number of requests handled by the proxy, by handler and status code.",
+		}, []string{"handler", "code"}),
+		scrapes: prometheus.NewCounter(prometheus.CounterOpts{
+			Name: "expvar_exporter_scrapes_total",
+			Help: "Number of requests to targets, not counting retries.",
+		}),
+		scrapeErrors: prometheus.NewCounter(prometheus.CounterOpts{
+			Name: "expvar_exporter_scrape_errors_total",
+			Help: "Number of failed scrapes of targets.",
+		}),
+		scrapedBytes: prometheus.NewCounter(prometheus.CounterOpts{
+			Name: "expvar_exporter_scraped_bytes_total",
+			Help: "Number of decompressed bytes read from targets.",
+		}),
+	}
+	t.Registry.MustRegister(
+		collectors.NewProcessCollector(collectors.ProcessCollectorOpts{}),
+		collectors.NewGoCollector(),
+		versioncollector.NewCollector("expvar_exporter"),
+		t.requests, t.scrapes, t.scrapeErrors, t.scrapedBytes,
+	)
+	return t
+}
+
+// Request counts a request handled by the proxy. handler is the route, e.g.
+// "proxy" or "/probe".
+func (t *Telemetry) Request(handler string, code int) {
+	if t == nil {
+		return
+	}
+	t.requests.WithLabelValues(handler, strconv.Itoa(code)).Inc()
+}
+
+// Scrape counts a scrape of a target, which read n bytes and failed with err
+// if not nil.
+func (t *Telemetry) Scrape(n int64, err error) {
+	if t == nil {
+		return
+	}
+	t.scrapes.Inc()
+	t.scrapedBytes.Add(float64(n))
+	if err != nil {
+		t.scrapeErrors.Inc()
+	}
+}
+
+// Handler serves the metrics of the proxy.
+func (t *Telemetry) Handler() http.Handler {
+	return promhttp.HandlerFor(t.Registry, promhttp.HandlerOpts{})
+}
+
+// statusRecorder remembers the status code and the number of bytes written
+// to a response.
+type statusRecorder struct {
+	http.ResponseWriter
+	code  int
+	bytes int64
+}
+
+func (r *statusRecorder) WriteHeader(code int) {
+	r.code = code
+	r.ResponseWriter.WriteHeader(code)
+}
+
+func (r *statusRecorder) Write(p []byte) (int, error) {
+	n, err := r.ResponseWriter.Write(p)
+	r.bytes += int64(n)
+	return n, err
+}
+
+func (r *statusRecorder) Unwrap() http.ResponseWriter {
+	return r.ResponseWriter
+}
+
+// route returns the handler label of the request: "proxy" for proxy requests,
+// otherwise the pattern of mux it matches, or "other".
+func route(mux *http.ServeMux, req *http.Request) string {
+	if req.URL.IsAbs() {
+		return "proxy"
+	}
+	if _, pattern := mux.Handler(req); pattern != "" {
+		return pattern
+	}
+	return "other"
+}
@@ -0,0 +1,99 @@
+package main
+
+import (
+	"context"
+	"net/http"
+	"net/url"
+
+	"github.com/prometheus/common/version"
+	"go.opentelemetry.io/contrib/instrumentation/net/http/otelhttp"
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/codes"
+	"go.opentelemetry.io/otel/exporters/otlp/otlptrace/otlptracehttp"
+	"go.opentelemetry.io/otel/propagation"
+	"go.opentelemetry.io/otel/sdk/resource"
+	sdktrace "go.opentelemetry.io/otel/sdk/trace"
+	semconv "go.opentelemetry.io/otel/semconv/v1.43.0"
+	"go.opentelemetry.io/otel/trace"
+	"go.opentelemetry.io/otel/trace/noop"
+)
+
+// tracerName is the instrumentation scope of the spans of the proxy.
+const tracerName = "github.com/relex/prometheus-expvar-proxy"
+
+// newTracerProvider returns a provider exporting spans over OTLP/HTTP to
+// endpoint, e.g. http://localhost:4318, or to /v1/traces there if it has no
+// path. Traces not sampled by the caller already are sampled at ratio. The
+// provider is also installed as the global one.
+func newTracerProvider(ctx context.Context, endpoint string, ratio float64) (*sdktrace.TracerProvider, error) {
+	u, err := url.Parse(endpoint)
+	if err != nil {
+		return nil, err
+	}
+	if u.Path == "" || u.Path == "/" {
+		u.Path = "/v1/traces"
+	}
+	exporter, err := otlptracehttp.New(ctx, otlptracehttp.WithEndpointURL(u.String()))
+	if err != nil {
+		return nil, err
+	}
+	res, err := resource.Merge(resource.Default(), resource.NewWithAttributes(semconv.SchemaURL,
+		semconv.ServiceName(programName),
+		semconv.ServiceVersion(version.Version),
+	))
+	if err != nil {
+		return nil, err
+	}
+	tp := sdktrace.NewTracerProvider(
+		sdktrace.WithBatcher(exporter),
+		sdktrace.WithResource(res),
+		sdktrace.WithSampler(sdktrace.ParentBased(sdktrace.TraceIDRatioBased(ratio))),
+	)
+	otel.SetTracerProvider(tp)
+	otel.SetTextMapPropagator(propagation.NewCompositeTextMapPropagator(propagation.TraceContext{}, propagation.Baggage{}))
+	return tp, nil
+}
+
+// tracer returns the tracer of the proxy, which discards spans if tracing
+// isn't enabled.
+func (p *Proxy) tracer() trace.Tracer {
+	if p.TracerProvider == nil {
+		return noop.NewTracerProvider().Tracer(tracerName)
+	}
+	return p.TracerProvider.Tracer(tracerName)
+}
+
+// tracedTransport returns rt with a span for every request to targets, if
+// tracing is enabled.
+func (p *Proxy) tracedTransport(rt http.RoundTripper) http.RoundTripper {
+	if p.TracerProvider == nil {
+		return rt
+	}
+	if rt == nil {
+		rt = http.DefaultTransport
+	}
+	return otelhttp.NewTransport(rt, otelhttp.WithTracerProvider(p.TracerProvider))
+}
+
+// tracedHandler returns h with a span for every request to the proxy, named
+// after the route, if tracing is enabled.
+func (p *Proxy) tracedHandler(h http.Handler, mux *http.ServeMux) http.Handler {
+	if p.TracerProvider == nil {
+		return h
+	}
+	return otelhttp.NewHandler(h, "request",
+		otelhttp.WithTracerProvider(p.TracerProvider),
+		otelhttp.WithSpanNameFormatter(func(_ string, req *http.Request) string {
+			return req.Method + " " + route(mux, req)
+		}),
+	)
+}
+
+// endSpan records err, if any, and ends the span.
+func endSpan(span trace.Span, err error) {
+	if err != nil {
+		span.RecordError(err)
+		span.SetStatus(codes.Error, err.Error())
+	}
+	span.End()
+}
@@ -0,0 +1,121 @@
+package main
+
+import (
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"fmt"
+	"net"
+	"net/http"
+	"net/url"
+	"os"
+	"strings"
+)
+
+// newTransport returns a transport to targets with the TLS settings, which
+// otherwise behaves like http.DefaultTransport, except for denying private
+// networks if privateNetworksDenied.
+func newTransport(tc *TLSConfig) (*http.Transport, error) {
+	tlsConfig, err := tc.build()
+	if err != nil {
+		return nil, err
+	}
+	t := http.DefaultTransport.(*http.Transport).Clone()
+	t.TLSClientConfig = tlsConfig
+	if privateNetworksDenied {
+		denyPrivateNetworks(t)
+	}
+	return t, nil
+}
+
+// buildTransport sets the transport of the target if it needs one of its own,
+// for the TLS settings, the proxy or the unix socket if not empty.
+func (t *TargetConfig) buildTransport(socket string) error {
+	if t.TLS == nil && t.ProxyURL == "" && socket == "" {
+		return nil
+	}
+	tlsConfig := t.TLS
+	if tlsConfig == nil {
+		tlsConfig = &TLSConfig{}
+	}
+	transport, err := newTransport(tlsConfig)
+	if err != nil {
+		return fmt.Errorf("invalid tls_config: %w", err)
+	}
+	if t.ProxyURL != "" {
+		if privateNetworksDenied {
+			return fmt.Errorf("proxy_url can't be used with -targets.deny-private-networks, which can't check targets behind proxies")
+		}
+		u, err := url.Parse(t.ProxyURL)
+		if err != nil {
+			return fmt.Errorf("invalid proxy_url: %w", err)
+		}
+		if u.Scheme != "http" && u.Scheme != "https" && u.Scheme != "socks5" || u.Host == "" {
+			return fmt.Errorf("invalid proxy_url %q: must be an http://, https:// or socks5:// URL", t.ProxyURL)
+		}
+		transport.Proxy = http.ProxyURL(u)
+	}
+	if socket != "" {
+		dialUnix(transport, socket)
+	}
+	t.transport = transport
+
+	// Token and STS endpoints are reached directly, or through the proxy of
+	// the environment, but with the TLS settings of the target.
+	if t.TLS != nil && (t.ProxyURL != "" || socket != "") {
+		if t.authTransport, err = newTransport(t.TLS); err != nil {
+			return fmt.Errorf("invalid tls_config: %w", err)
+		}
+	} else if t.TLS != nil {
+		t.authTransport = transport
+	}
+	return nil
+}
+
+// parseUnixURL splits "unix:///path/to/socket:/http/path" into the URL of the
+// HTTP path and the socket path, which must not contain colons.
+func parseUnixURL(u *url.URL) (*url.URL, string, error) {
+	if u.Host != "" || u.Opaque != "" {
+		return nil, "", fmt.Errorf("unix URLs must look like unix:///path/to/socket:/path, got %q", u)
+	}
+	socket, httpPath, _ := strings.Cut(u.Path, ":")
+	if socket == "" {
+		return nil, "", fmt.Errorf("missing socket path in %q", u)
+	}
+	return &url.URL{Scheme: "http", Host: "localhost", Path: httpPath, RawQuery: u.RawQuery}, socket, nil
+}
+
+// dialUnix makes the transport connect to the unix socket at path, whatever
+// the address of requests.
+func dialUnix(t *http.Transport, path string) {
+	var dialer net.Dialer
+	t.DialContext = func(ctx context.Context, _, _ string) (net.Conn, error) {
+		return dialer.DialContext(ctx, "unix", path)
+	}
+}
+
+// build returns the crypto/tls config, loading the files it refers to.
+func (tc *TLSConfig) build() (*tls.Config, error) {
+	cfg := &tls.Config{InsecureSkipVerify: tc.InsecureSkipVerify}
+	if tc.CAFile != "" {
+		pem, err := os.ReadFile(tc.CAFile)
+		if err != nil {
+			return nil, fmt.Errorf("error reading CA file: %w", err)
+		}
+		cfg.RootCAs = x509.NewCertPool()
+		if !cfg.RootCAs.AppendCertsFromPEM(pem) {
+			return nil, fmt.Errorf("no certificates found in CA file %q", tc.CAFile)
+		}
+	}
+	if tc.CertFile != "" || tc.KeyFile != "" {
+		if tc.CertFile == "" || tc.KeyFile == "" {
+			return nil, fmt.Errorf("cert_file and key_file must be set together")
+		}
+		cert, err := tls.LoadX509KeyPair(tc.CertFile, tc.KeyFile)
+		if err != nil {
+			return nil, fmt.Errorf("error loading client certificate: %w", err)
+		}
+		cfg.Certificates = []tls.Certificate{cert}
+	}
+	return cfg, nil
+}